@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the content of the optional configuration file
+type config struct {
+	settings  `yaml:",inline"`
+	Env       map[string]string    `yaml:"env"`
+	Templates map[string]template  `yaml:"templates"`
+	Layouts   map[string]layoutDef `yaml:"layouts"`
+
+	// ProjectDirs are the directories whose subdirectories -pick lists, unless given on the command line
+	ProjectDirs []string `yaml:"project_dirs"`
+	// Ignore holds the patterns of the directories that -pick skips, replacing defaultIgnore if set
+	Ignore []string `yaml:"ignore"`
+
+	// TemplatesDir holds a template in each .yaml file, named by the file name, which
+	// take precedence over Templates. It defaults to templates next to the config file,
+	// and a relative path is relative to the config file.
+	TemplatesDir string `yaml:"templates_dir"`
+
+	templateFiles map[string]template // the templates read from TemplatesDir, by name
+
+	// Hosts holds settings that override the top-level ones on the named hosts
+	Hosts map[string]settings `yaml:"hosts"`
+
+	host string // the entry of Hosts that was merged, if any
+
+	// tmux holds the defaults from the global options of the tmux server, and file the
+	// settings from the file that replace them, once merged by mergeTmux
+	tmux, file *settings
+}
+
+// settings are the config values that can be overridden per host. Unset values are nil.
+type settings struct {
+	WideThreshold *int  `yaml:"wide_threshold"`
+	NarrowWidth   *int  `yaml:"narrow_width"`
+	NarrowHeight  *int  `yaml:"narrow_height"`
+	WideMainWidth *int  `yaml:"wide_main_width"`
+	MaxWindows    *int  `yaml:"max_windows"`
+	GitRoot       *bool `yaml:"git_root"`
+	MainPane      *int  `yaml:"main_pane"`
+	Panes         *int  `yaml:"panes"`
+
+	DefaultSession *string `yaml:"default_session"`
+
+	// The time limits of the tmux commands, as Go durations such as 500ms. Timeout is
+	// used for queries and batches unless QueryTimeout or BatchTimeout is set, and there
+	// is no limit by default.
+	Timeout      *time.Duration `yaml:"timeout"`
+	QueryTimeout *time.Duration `yaml:"query_timeout"`
+	BatchTimeout *time.Duration `yaml:"batch_timeout"`
+}
+
+// merge sets the values of s that are set in o
+func (s *settings) merge(o settings) {
+	if o.WideThreshold != nil {
+		s.WideThreshold = o.WideThreshold
+	}
+	if o.NarrowWidth != nil {
+		s.NarrowWidth = o.NarrowWidth
+	}
+	if o.NarrowHeight != nil {
+		s.NarrowHeight = o.NarrowHeight
+	}
+	if o.WideMainWidth != nil {
+		s.WideMainWidth = o.WideMainWidth
+	}
+	if o.MaxWindows != nil {
+		s.MaxWindows = o.MaxWindows
+	}
+	if o.GitRoot != nil {
+		s.GitRoot = o.GitRoot
+	}
+	if o.MainPane != nil {
+		s.MainPane = o.MainPane
+	}
+	if o.Panes != nil {
+		s.Panes = o.Panes
+	}
+	if o.DefaultSession != nil {
+		s.DefaultSession = o.DefaultSession
+	}
+	if o.Timeout != nil {
+		s.Timeout = o.Timeout
+	}
+	if o.QueryTimeout != nil {
+		s.QueryTimeout = o.QueryTimeout
+	}
+	if o.BatchTimeout != nil {
+		s.BatchTimeout = o.BatchTimeout
+	}
+}
+
+// timeouts returns the time limits of queries and of batches of commands, falling back
+// to Timeout for either, and 0 for no limit
+func (s *settings) timeouts() (query, batch time.Duration) {
+	if s.Timeout != nil {
+		query, batch = *s.Timeout, *s.Timeout
+	}
+	if s.QueryTimeout != nil {
+		query = *s.QueryTimeout
+	}
+	if s.BatchTimeout != nil {
+		batch = *s.BatchTimeout
+	}
+
+	return query, batch
+}
+
+// template is a named set of workspace settings, selected with -template
+type template struct {
+	Env map[string]string `yaml:"env,omitempty"`
+
+	// Options are tmux options set on the window of the workspace, by name
+	Options map[string]string `yaml:"options,omitempty"`
+
+	// The panes and tmux layout string of a window, as captured by -export-template
+	Panes  []templatePane `yaml:"panes,omitempty"`
+	Layout string         `yaml:"layout,omitempty"`
+}
+
+// templatePane is a pane of a template
+type templatePane struct {
+	Dir     string `yaml:"dir,omitempty"`     // relative to the workspace directory, unless absolute
+	Command string `yaml:"command,omitempty"` // the command to run in the pane
+}
+
+// layoutDef is a layout defined in the config, which names the panes of a built-in
+// layout so that commands and titles can refer to panes by name
+type layoutDef struct {
+	Layout   string            `yaml:"layout"`   // the built-in layout, picked from the window width if empty
+	Panes    []string          `yaml:"panes"`    // the pane names, by index
+	Commands map[string]string `yaml:"commands"` // commands to run, by pane name
+	Titles   map[string]string `yaml:"titles"`   // pane titles, by pane name
+	Focus    string            `yaml:"focus"`    // the pane to focus
+	Extends  string            `yaml:"extends"`  // the config or built-in layout that this one overrides
+
+	// FocusAfterRun is a pane to focus once its command is started, instead of Focus
+	FocusAfterRun string `yaml:"focus_after_run"`
+}
+
+// paneIndex returns the index of the named pane
+func (l *layoutDef) paneIndex(layout, pane string) (int, error) {
+	for i, p := range l.Panes {
+		if p == pane {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("pane %s isn't defined in layout %s", pane, layout)
+}
+
+// byIndex translates a map keyed by pane name to one keyed by pane index
+func (l *layoutDef) byIndex(layout string, m map[string]string) (map[int]string, error) {
+	result := map[int]string{}
+	for pane, v := range m {
+		i, err := l.paneIndex(layout, pane)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = v
+	}
+
+	return result, nil
+}
+
+// layout returns the named layout from the config, merged with the layouts it extends.
+// It returns false if there is no such layout in the config.
+func (cfg *config) layout(name string) (*layoutDef, bool, error) {
+	def, ok := cfg.Layouts[name]
+	if !ok {
+		return nil, false, nil
+	}
+
+	// Collect the chain of layouts, from this one to the base
+	chain := []layoutDef{def}
+	names := []string{name}
+	for def.Extends != "" {
+		parent := def.Extends
+		names = append(names, parent)
+		for _, n := range names[:len(names)-1] {
+			if n == parent {
+				return nil, true, fmt.Errorf("layouts extend each other in a cycle: %s", strings.Join(names, " -> "))
+			}
+		}
+
+		var ok bool
+		if def, ok = cfg.Layouts[parent]; !ok {
+			if lookupLayout(parent) == nil {
+				return nil, true, fmt.Errorf("layout %s extends unknown layout %s", name, parent)
+			}
+			def = layoutDef{Layout: parent}
+		}
+		chain = append(chain, def)
+	}
+
+	// Apply the overrides from the base up
+	var result layoutDef
+	for i := len(chain) - 1; i >= 0; i-- {
+		result.merge(chain[i])
+	}
+	result.Extends = ""
+
+	return &result, true, nil
+}
+
+// merge sets the values of l that are set in o, merging the maps by key
+func (l *layoutDef) merge(o layoutDef) {
+	if o.Layout != "" {
+		l.Layout = o.Layout
+	}
+	if o.Panes != nil {
+		l.Panes = o.Panes
+	}
+	if o.Focus != "" {
+		l.Focus = o.Focus
+	}
+	if o.FocusAfterRun != "" {
+		l.FocusAfterRun = o.FocusAfterRun
+	}
+	l.Commands = mergeMap(l.Commands, o.Commands)
+	l.Titles = mergeMap(l.Titles, o.Titles)
+}
+
+// mergeMap returns a copy of a with the entries of b added
+func mergeMap(a, b map[string]string) map[string]string {
+	if a == nil && b == nil {
+		return nil
+	}
+
+	result := map[string]string{}
+	for _, m := range []map[string]string{a, b} {
+		for k, v := range m {
+			result[k] = v
+		}
+	}
+
+	return result
+}
+
+// defaultConfigPath returns the location of the config file, or "" if no config dir can be determined
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "tmux-workspace", "config.yaml")
+}
+
+// goTypeName matches the Go type in the errors of the YAML decoder, which tell the line
+// of the offending key well enough without it
+var goTypeName = regexp.MustCompile(` in type main\.\w+`)
+
+// loadConfig reads the config file, and the template files. A missing file gives an
+// empty config.
+func loadConfig(path string) (*config, error) {
+	var cfg config
+	if path == "" {
+		return &cfg, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := decodeStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	dir := filepath.Join(filepath.Dir(path), "templates")
+	if cfg.TemplatesDir != "" {
+		dir = os.ExpandEnv(cfg.TemplatesDir)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(path), dir)
+		}
+	}
+	if cfg.templateFiles, err = loadTemplateFiles(dir); err != nil {
+		return nil, err
+	}
+
+	if host, err := os.Hostname(); err == nil {
+		for _, h := range []string{host, strings.SplitN(host, ".", 2)[0]} {
+			if s, ok := cfg.Hosts[h]; ok {
+				cfg.merge(s)
+				cfg.host = h
+				break
+			}
+		}
+	}
+
+	return &cfg, nil
+}
+
+// decodeStrict decodes YAML into v, rejecting unknown keys as they are likely typos.
+// Empty input leaves v as it is.
+func decodeStrict(b []byte, v interface{}) error {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return errors.New(goTypeName.ReplaceAllString(err.Error(), ""))
+	}
+
+	return nil
+}
+
+// loadTemplateFiles reads the templates from the .yaml files in dir, named by the file
+// names. A missing dir gives no templates.
+func loadTemplateFiles(dir string) (map[string]template, error) {
+	// The pattern is only invalid if dir has a malformed pattern in it, in which case it
+	// is treated as missing
+	files, _ := filepath.Glob(filepath.Join(dir, "*.yaml"))
+
+	result := map[string]template{}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template: %w", err)
+		}
+
+		var t template
+		if err := decodeStrict(b, &t); err != nil {
+			return nil, fmt.Errorf("failed to parse template %s: %w", f, err)
+		}
+		result[strings.TrimSuffix(filepath.Base(f), ".yaml")] = t
+	}
+
+	return result, nil
+}
+
+// validate checks the parts of the config that are only resolved when used: the
+// layouts and the templates
+func (cfg *config) validate() error {
+	var names []string
+	for name := range cfg.Layouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l, _, err := cfg.layout(name)
+		if err != nil {
+			return err
+		}
+		if l.Layout != "" && lookupLayout(l.Layout) == nil {
+			return fmt.Errorf("layout %s is based on unknown layout %s", name, l.Layout)
+		}
+		for _, m := range []map[string]string{l.Commands, l.Titles} {
+			if _, err := l.byIndex(name, m); err != nil {
+				return err
+			}
+		}
+		for _, pane := range []string{l.Focus, l.FocusAfterRun} {
+			if _, err := l.paneIndex(name, pane); pane != "" && err != nil {
+				return err
+			}
+		}
+	}
+
+	names = nil
+	for name := range cfg.Templates {
+		if _, ok := cfg.templateFiles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for name := range cfg.templateFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := cfg.template(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ignorePatterns returns the patterns of the directories to skip when listing them, the
+// configured ones or defaultIgnore
+func (cfg *config) ignorePatterns() []string {
+	if cfg.Ignore != nil {
+		return cfg.Ignore
+	}
+
+	return defaultIgnore
+}
+
+// tmuxDefaultPrefix starts the names of the global tmux options holding defaults for the
+// settings, e.g. @tmux_workspace_default_wide_threshold. It differs from the window
+// options of a workspace, which start with @tmux_workspace_ too.
+const tmuxDefaultPrefix = "@tmux_workspace_default_"
+
+// tmuxSettings reads the settings from the global options of the tmux server. Without a
+// server to ask, there are none.
+func tmuxSettings() (settings, error) {
+	var s settings
+	out, err := queryTmux("show-options", "-g")
+	if err != nil {
+		return s, nil
+	}
+
+	doc := yaml.Node{Kind: yaml.MappingNode}
+	for _, line := range strings.Split(out, "\n") {
+		name := strings.SplitN(line, " ", 2)[0]
+		if !strings.HasPrefix(name, tmuxDefaultPrefix) {
+			continue
+		}
+
+		value, err := queryTmux("show-options", "-gv", name)
+		if err != nil {
+			return s, fmt.Errorf("failed to get option %s: %w", name, err)
+		}
+		doc.Content = append(doc.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: strings.TrimPrefix(name, tmuxDefaultPrefix)},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: strings.TrimSuffix(value, "\n")},
+		)
+	}
+
+	if err := doc.Decode(&s); err != nil {
+		return s, fmt.Errorf("invalid %s option: %w", tmuxDefaultPrefix, err)
+	}
+
+	return s, nil
+}
+
+// mergeTmux adds the settings from the tmux options, below those from the file
+func (cfg *config) mergeTmux(t settings) {
+	file := cfg.settings
+	cfg.tmux, cfg.file = &t, &file
+
+	cfg.settings = t
+	cfg.settings.merge(file)
+}
+
+// layoutOptions gives the layout sizes, with the configured values replacing the defaults
+func (cfg *config) layoutOptions() layoutOptions {
+	opts := defaultLayoutOptions
+	if cfg.WideThreshold != nil {
+		opts.wideThreshold = *cfg.WideThreshold
+	}
+	if cfg.NarrowWidth != nil {
+		opts.narrowWidth = *cfg.NarrowWidth
+	}
+	if cfg.NarrowHeight != nil {
+		opts.narrowHeight = *cfg.NarrowHeight
+	}
+	if cfg.WideMainWidth != nil {
+		opts.wideMainWidth = *cfg.WideMainWidth
+	}
+	if cfg.MainPane != nil {
+		opts.mainPane = *cfg.MainPane
+	}
+
+	return opts
+}
+
+// source tells where a setting comes from, given a function that tells if it is set in
+// some settings: the host entry, the file, or the default
+func (cfg *config) source(isSet func(s settings) bool) string {
+	if cfg.host != "" && isSet(cfg.Hosts[cfg.host]) {
+		return "host " + cfg.host
+	}
+	if cfg.file == nil && isSet(cfg.settings) || cfg.file != nil && isSet(*cfg.file) {
+		return "file"
+	}
+	if cfg.tmux != nil && isSet(*cfg.tmux) {
+		return "tmux option"
+	}
+
+	return "default"
+}
+
+// resolvedValue is a setting in effect, and where it comes from
+type resolvedValue struct {
+	key    string
+	value  interface{}
+	source string
+}
+
+// showConfig writes the settings in effect as YAML, followed by the maps of the config.
+// With withSource set, each setting is commented with its source.
+func showConfig(w io.Writer, values []resolvedValue, cfg *config, withSource bool) error {
+	for _, v := range values {
+		// The flow style keeps lists on the line of the key, with the comment
+		var n yaml.Node
+		if err := n.Encode(v.value); err != nil {
+			return err
+		}
+		n.Style = yaml.FlowStyle
+		b, err := yaml.Marshal(map[string]*yaml.Node{v.key: &n})
+		if err != nil {
+			return err
+		}
+		line := strings.TrimSuffix(string(b), "\n")
+		if withSource {
+			line += " # " + v.source
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	// The templates in effect include those from the template files
+	templates := cfg.Templates
+	if len(cfg.templateFiles) > 0 {
+		templates = map[string]template{}
+		for _, m := range []map[string]template{cfg.Templates, cfg.templateFiles} {
+			for name, t := range m {
+				templates[name] = t
+			}
+		}
+	}
+
+	maps := struct {
+		Env       map[string]string    `yaml:"env,omitempty"`
+		Templates map[string]template  `yaml:"templates,omitempty"`
+		Layouts   map[string]layoutDef `yaml:"layouts,omitempty"`
+	}{cfg.Env, templates, cfg.Layouts}
+	if maps.Env == nil && maps.Templates == nil && maps.Layouts == nil {
+		return nil
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(maps); err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
+
+// template looks up a named template. The empty name gives an empty template.
+func (cfg *config) template(name string) (*template, error) {
+	if name == "" {
+		return &template{}, nil
+	}
+
+	// A template file replaces the template with the same name in the config
+	t, ok := cfg.templateFiles[name]
+	if !ok {
+		t, ok = cfg.Templates[name]
+	}
+	if !ok {
+		return nil, fmt.Errorf("no such template: %s", name)
+	}
+
+	// The values are passed on to tmux, but a name must be a single word
+	for k := range t.Options {
+		if k == "" || strings.HasPrefix(k, "-") || strings.ContainsAny(k, " \t\n;") {
+			return nil, fmt.Errorf("invalid option name %q in template %s", k, name)
+		}
+	}
+
+	return &t, nil
+}
+
+// exportTemplate adds a template to the config file at path, keeping the rest of the
+// file. An existing template with the same name is replaced only with force.
+func exportTemplate(path, name string, t *template, force bool) error {
+	var doc yaml.Node
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("config %s isn't a mapping", path)
+	}
+	templates := mappingValue(root, "templates")
+
+	var value yaml.Node
+	if err := value.Encode(t); err != nil {
+		return err
+	}
+	existing := mappingValue(templates, name)
+	if len(existing.Content) > 0 && !force {
+		return fmt.Errorf("template %s already exists, use -force to replace it", name)
+	}
+	*existing = value
+
+	var out strings.Builder
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create config dir: %w", err)
+	}
+
+	return os.WriteFile(path, []byte(out.String()), 0o644)
+}
+
+// mappingValue returns the value of key in a YAML mapping, adding an empty mapping
+// for it if it's missing
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+
+	value := &yaml.Node{Kind: yaml.MappingNode}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+
+	return value
+}
+
+// stringList is a flag.Value that collects the values of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// workspaceEnv merges the environment for the panes of a workspace, starting
+// with HISTFILE unless histfile is empty. Later maps take precedence; values from the config are
+// expanded against the current environment, values from the command line are
+// used as is.
+func workspaceEnv(histfile string, cfg *config, tmpl *template, cliEnv []string) ([]string, error) {
+	// TODO: make HISTFILE optional? maybe check if it exists or smth.
+	env := map[string]string{}
+	if histfile != "" {
+		env["HISTFILE"] = histfile
+	}
+
+	for _, m := range []map[string]string{cfg.Env, tmpl.Env} {
+		for k, v := range m {
+			env[k] = os.ExpandEnv(v)
+		}
+	}
+
+	for _, kv := range cliEnv {
+		i := strings.Index(kv, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("expected KEY=VALUE, got: %s", kv)
+		}
+		env[kv[:i]] = kv[i+1:]
+	}
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := make([]string, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, k+"="+env[k])
+	}
+
+	return result, nil
+}
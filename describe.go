@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// describePlan explains in plain English what running the commands of a plan does
+func describePlan(p *plan, sizes layoutOptions) string {
+	win := fmt.Sprintf("window '%s' in session '%s'", p.Window, p.Session)
+	if len(p.Commands)+len(p.Startup) == 0 {
+		if p.Layout != "" {
+			return fmt.Sprintf("Nothing to do for %s, it already has the %s layout.", win, p.Layout)
+		}
+		return fmt.Sprintf("Nothing to do for %s.", win)
+	}
+
+	var b strings.Builder
+	switch p.Action {
+	case "open":
+		first := ""
+		if cmds := splitCommands(p.Commands); len(cmds) > 0 {
+			first = cmds[0][0]
+		}
+
+		switch first {
+		case "new-session":
+			fmt.Fprintf(&b, "Will create session '%s' with window '%s'", p.Session, p.Window)
+		case "rename-window":
+			fmt.Fprintf(&b, "Will turn the current window into window '%s' in session '%s'", p.Window, p.Session)
+		default:
+			fmt.Fprintf(&b, "Will create %s", win)
+		}
+		if p.Directory != "" {
+			fmt.Fprintf(&b, " for %s", p.Directory)
+		}
+
+		if p.Panes == 1 {
+			b.WriteString(" with 1 pane")
+		} else {
+			fmt.Fprintf(&b, " with %d panes", p.Panes)
+			if p.Layout != "" {
+				fmt.Fprintf(&b, " using the %s layout%s", p.Layout, describeSizes(p.Layout, sizes))
+			} else {
+				b.WriteString(" using the layout of the template")
+			}
+		}
+
+		if started := describeStartup(p.Startup); len(started) > 0 {
+			b.WriteString(", starting " + strings.Join(started, ", "))
+		}
+		b.WriteString(".")
+
+		if p.Attach != "" {
+			fmt.Fprintf(&b, " Then attaches to session '%s'.", p.Attach)
+		}
+	case "flip":
+		fmt.Fprintf(&b, "Will flip %s to the %s layout%s.", win, p.Layout, describeSizes(p.Layout, sizes))
+	case "refresh", "apply-layout":
+		fmt.Fprintf(&b, "Will apply the %s layout%s to %s.", p.Layout, describeSizes(p.Layout, sizes), win)
+	case "add-pane":
+		fmt.Fprintf(&b, "Will split %s into %d panes in %s, and apply the %s layout%s.", win, p.Panes, p.Directory, p.Layout, describeSizes(p.Layout, sizes))
+	case "remove-pane":
+		if p.Panes == 0 {
+			fmt.Fprintf(&b, "Will kill the last pane of %s, closing the window.", win)
+		} else if p.Layout != "" {
+			fmt.Fprintf(&b, "Will kill a pane of %s, leaving %d panes in the %s layout%s.", win, p.Panes, p.Layout, describeSizes(p.Layout, sizes))
+		} else {
+			fmt.Fprintf(&b, "Will kill a pane of %s, leaving %d panes.", win, p.Panes)
+		}
+	case "kill":
+		fmt.Fprintf(&b, "Will kill %s", win)
+		if p.Remove != "" {
+			fmt.Fprintf(&b, ", and remove the scratch directory %s", p.Remove)
+		}
+		b.WriteString(".")
+	case "pin":
+		fmt.Fprintf(&b, "Will pin %s, so that -kill-all skips it.", win)
+	case "unpin":
+		fmt.Fprintf(&b, "Will unpin %s.", win)
+	case "focus":
+		fmt.Fprintf(&b, "Will select %s.", win)
+	case "install-keybinding":
+		fmt.Fprintf(&b, "Will bind the key %s to flip the layout of the current window.", p.Commands[1])
+	default:
+		fmt.Fprintf(&b, "Will run %d tmux commands to %s %s.", len(splitCommands(p.Commands))+len(splitCommands(p.Startup)), p.Action, win)
+	}
+
+	return b.String()
+}
+
+// describeSizes tells the sizes of the panes of a built-in layout, in parentheses
+func describeSizes(layout string, sizes layoutOptions) string {
+	cols := func(abs, percent int) string {
+		if percent > 0 {
+			return fmt.Sprintf("%d%% of the width", percent)
+		}
+		return fmt.Sprintf("%d cols", abs)
+	}
+
+	var desc string
+	switch layout {
+	case "wide":
+		desc = "main pane " + cols(sizes.wideMainWidth, sizes.wideMainPercent)
+	case "narrow":
+		desc = "secondary panes " + cols(sizes.narrowWidth, sizes.narrowPercent)
+	default:
+		return ""
+	}
+	if sizes.mainPane != 0 {
+		desc += fmt.Sprintf(", with pane %d as the main pane", sizes.mainPane)
+	}
+	if sizes.resizePane >= 0 {
+		desc += fmt.Sprintf(", set on pane %d", sizes.resizePane)
+	}
+
+	return " (" + desc + ")"
+}
+
+// describeStartup lists the commands that are typed into the panes by the startup
+// commands of a plan, with the pane they are typed in
+func describeStartup(startup []string) []string {
+	var result []string
+	for _, cmd := range splitCommands(startup) {
+		if cmd[0] != "send-keys" || len(cmd) < 4 {
+			continue
+		}
+
+		pane := cmd[2]
+		if i := strings.LastIndex(pane, "."); i >= 0 {
+			pane = pane[i+1:]
+		}
+		result = append(result, fmt.Sprintf("'%s' in pane %s", cmd[3], pane))
+	}
+
+	return result
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// layoutOptions holds the sizes used when picking and applying layouts
+type layoutOptions struct {
+	wideThreshold int // the window width from which the wide layout is picked
+	narrowWidth   int // the width of the secondary panes in the narrow layout
+	narrowHeight  int // the height of the upper secondary pane in the narrow layout
+	wideMainWidth int // the width of the main pane in the wide layout
+
+	// The sizes in percent of the window width, which replace the absolute sizes if above 0
+	narrowPercent   int
+	wideMainPercent int
+
+	// decision is how the layout is picked: by the window width, from wideThreshold, or
+	// by the aspect, the width divided by the height, from aspectCutoff
+	decision     string
+	aspectCutoff float64
+
+	mainPane   int // the index of the main pane
+	resizePane int // the index of the pane that the layouts resize, or -1 for the one of each layout
+
+	heightOffset int // rows added to narrowHeight, to make up for the pane border status line
+
+	baseIndex int // the pane-base-index of tmux, which the pane indices are counted from
+}
+
+// pane returns the target of the pane with index i in win, counting from the first pane
+func (opts layoutOptions) pane(win string, i int) string {
+	return fmt.Sprintf("%s.%d", win, opts.baseIndex+i)
+}
+
+// secondaryPane returns the index of the pane that trades places with the main pane
+func (opts layoutOptions) secondaryPane() int {
+	if opts.mainPane == 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// resized returns the index of the pane to resize, pane unless another one is set
+func (opts layoutOptions) resized(pane int) int {
+	if opts.resizePane >= 0 {
+		return opts.resizePane
+	}
+
+	return pane
+}
+
+// minPanes returns the number of panes a window needs for the layouts to arrange its
+// main and secondary pane, and the pane they resize
+func (opts layoutOptions) minPanes() int {
+	n := opts.secondaryPane() + 1
+	if opts.mainPane >= n {
+		n = opts.mainPane + 1
+	}
+	if opts.resizePane >= n {
+		n = opts.resizePane + 1
+	}
+
+	return n
+}
+
+// defaultLayoutOptions are the sizes used unless configured otherwise
+var defaultLayoutOptions = layoutOptions{
+	wideThreshold: 300,
+	narrowWidth:   90,
+	narrowHeight:  20,
+	wideMainWidth: 100,
+	decision:      "width",
+	aspectCutoff:  3,
+	resizePane:    -1,
+}
+
+// layoutFunc gives the tmux commands of a layout for a window. The commands must be safe
+// to run again on a window that already has the layout, as -refresh and -flip-to -force
+// do; select-layout with a preset, resize-pane to the size a pane already has and
+// select-pane all succeed without changes, also in a zoomed window, which they unzoom.
+type layoutFunc func(win string, opts layoutOptions) []string
+
+// layouts maps each layout name to its layoutFunc. Use RegisterLayout, lookupLayout and
+// layoutNames, which guard it with layoutsMu.
+var (
+	layoutsMu sync.RWMutex
+	layouts   = map[string]layoutFunc{
+		"narrow":  narrowScreenLayout,
+		"wide":    wideScreenLayout,
+		"columns": columnsLayout,
+		"rows":    rowsLayout,
+	}
+)
+
+// RegisterLayout adds a layout that -layout and -flip-to then accept, or returns an
+// error if there is one with the name already. It is safe to call concurrently.
+func RegisterLayout(name string, build layoutFunc) error {
+	if name == "" || build == nil {
+		return fmt.Errorf("invalid layout %q, expected a name and a layoutFunc", name)
+	}
+
+	layoutsMu.Lock()
+	defer layoutsMu.Unlock()
+
+	if _, ok := layouts[name]; ok {
+		return fmt.Errorf("layout %s is already registered", name)
+	}
+	layouts[name] = build
+
+	return nil
+}
+
+// lookupLayout returns the named layout, or nil if there is none
+func lookupLayout(name string) layoutFunc {
+	layoutsMu.RLock()
+	defer layoutsMu.RUnlock()
+
+	return layouts[name]
+}
+
+// layoutNames returns the names of the registered layouts, sorted
+func layoutNames() []string {
+	layoutsMu.RLock()
+	defer layoutsMu.RUnlock()
+
+	names := make([]string, 0, len(layouts))
+	for name := range layouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// layoutOption is the window option where the name of the applied layout is stored
+const layoutOption = "@tmux_workspace_layout"
+
+// layoutStringOption is the window option where the tmux layout string is stored
+// after applying a layout, to tell if the panes have been rearranged since
+const layoutStringOption = "@tmux_workspace_layout_string"
+
+// pairLayouts maps the layout picked for a window with workspace panes to the one
+// picked instead for a window with two panes
+var pairLayouts = map[string]string{
+	"narrow": "rows",
+	"wide":   "columns",
+}
+
+// layoutForPanes maps a layout to the one that arranges a window with the number of
+// panes the same way: a layout of pairLayouts to its pair for two panes, and back for
+// more. Other layouts are kept.
+func layoutForPanes(name string, panes int) string {
+	if panes == 2 {
+		if pair, ok := pairLayouts[name]; ok {
+			return pair
+		}
+		return name
+	}
+
+	for layout, pair := range pairLayouts {
+		if pair == name {
+			return layout
+		}
+	}
+
+	return name
+}
+
+// chooseLayout validates the layout name, or picks one for a window with the number of
+// panes from the window size if name is empty
+func chooseLayout(name, windowWidth, windowHeight string, panes int, opts layoutOptions) (string, error) {
+	if name == "" {
+		name = "narrow"
+		if isWide(windowWidth, windowHeight, opts) {
+			name = "wide"
+		}
+		return layoutForPanes(name, panes), nil
+	}
+
+	if lookupLayout(name) == nil {
+		return "", fmt.Errorf("unknown layout: %s, expected one of: %s", name, strings.Join(layoutNames(), ", "))
+	}
+
+	return name, nil
+}
+
+// isWide tells if a window of the size gets the wide layout, by the width or the aspect
+// as opts.decision says. A size that can't be parsed is narrow.
+func isWide(windowWidth, windowHeight string, opts layoutOptions) bool {
+	width, err := strconv.Atoi(windowWidth)
+	if err != nil {
+		return false
+	}
+	if opts.decision != "aspect" {
+		return width >= opts.wideThreshold
+	}
+
+	height, err := strconv.Atoi(windowHeight)
+	if err != nil || height == 0 {
+		return false
+	}
+
+	return float64(width)/float64(height) >= opts.aspectCutoff
+}
+
+// applyLayout gives the commands of the named layout for a window, and stores the
+// name in the window's layout option
+func applyLayout(win, name string, opts layoutOptions) []string {
+	return append(lookupLayout(name)(win, opts),
+		"set-option", "-w", "-t", win, layoutOption, name, ";",
+		"set-option", "-w", "-F", "-t", win, layoutStringOption, "#{window_layout}", ";",
+	)
+}
+
+// withoutSelect removes the select-pane commands from cmds, to keep the focus where it is
+func withoutSelect(cmds []string) []string {
+	var result []string
+	for _, cmd := range splitCommands(cmds) {
+		if cmd[0] != "select-pane" {
+			result = append(append(result, cmd...), ";")
+		}
+	}
+
+	return result
+}
+
+// size formats a size for resize-pane, using the percentage if it is above 0
+func size(abs, percent int) string {
+	if percent > 0 {
+		return strconv.Itoa(percent) + "%"
+	}
+
+	return strconv.Itoa(abs)
+}
+
+// checkOrder returns an error if a command arranging panes comes before a command
+// creating panes, as the layout would then be applied to an incomplete window
+func checkOrder(cmds []string) error {
+	arranged := ""
+	for _, cmd := range splitCommands(cmds) {
+		switch cmd[0] {
+		case "select-layout", "resize-pane":
+			arranged = cmd[0]
+		case "new-session", "new-window", "split-window":
+			if arranged != "" {
+				return fmt.Errorf("%s comes after %s", cmd[0], arranged)
+			}
+		}
+	}
+
+	return nil
+}
+
+// narrowScreenLayout defines a layout intended for "small" screens
+func narrowScreenLayout(win string, opts layoutOptions) []string {
+	return []string{
+		"select-layout", "-t", win, "main-vertical", ";",
+		"resize-pane", "-x", size(opts.narrowWidth, opts.narrowPercent), "-y", strconv.Itoa(opts.narrowHeight + opts.heightOffset), "-t", opts.pane(win, opts.resized(opts.secondaryPane())), ";",
+		"select-pane", "-t", opts.pane(win, opts.mainPane), ";",
+	}
+}
+
+// wideScreenLayout defines a layout intended for large (4k-ish) screens
+func wideScreenLayout(win string, opts layoutOptions) []string {
+	return []string{
+		"select-layout", "-t", win, "even-horizontal", ";",
+		"resize-pane", "-x", size(opts.wideMainWidth, opts.wideMainPercent), "-t", opts.pane(win, opts.resized(opts.mainPane)), ";",
+		"select-pane", "-t", opts.pane(win, opts.secondaryPane()), ";",
+	}
+}
+
+// columnsLayout puts the two panes of a window side by side
+func columnsLayout(win string, opts layoutOptions) []string {
+	return []string{
+		"select-layout", "-t", win, "even-horizontal", ";",
+		"select-pane", "-t", opts.pane(win, opts.mainPane), ";",
+	}
+}
+
+// rowsLayout puts the two panes of a window above each other
+func rowsLayout(win string, opts layoutOptions) []string {
+	return []string{
+		"select-layout", "-t", win, "even-vertical", ";",
+		"select-pane", "-t", opts.pane(win, opts.mainPane), ";",
+	}
+}
+
+// parseSize parses a size given as WIDTHxHEIGHT
+func parseSize(s string) (int, int, error) {
+	parts := strings.Split(s, "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected WIDTHxHEIGHT, got: %s", s)
+	}
+
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width < 0 {
+		return 0, 0, fmt.Errorf("invalid width: %s", parts[0])
+	}
+	height, err := strconv.Atoi(parts[1])
+	if err != nil || height < 0 {
+		return 0, 0, fmt.Errorf("invalid height: %s", parts[1])
+	}
+
+	return width, height, nil
+}
+
+// minPaneSizeHook gives the commands that set a hook on a window to grow its panes back
+// to width and height when a layout change leaves them smaller. A width or height of 0
+// is no minimum. The hook runs again after growing a pane, until all panes are large
+// enough or can't grow. The panes are targeted relative to the window of the hook, so
+// renaming the window doesn't break it.
+func minPaneSizeHook(win string, panes int, sizes layoutOptions, width, height int) []string {
+	var clamps []string
+	for i := 0; i < panes; i++ {
+		pane := sizes.pane("", i)
+		if width > 0 {
+			clamps = append(clamps, tmuxQuote([]string{
+				"if-shell", "-F", "-t", pane, fmt.Sprintf("#{e|<:#{pane_width},%d}", width),
+				tmuxQuote([]string{"resize-pane", "-t", pane, "-x", strconv.Itoa(width)}),
+			}))
+		}
+		if height > 0 {
+			clamps = append(clamps, tmuxQuote([]string{
+				"if-shell", "-F", "-t", pane, fmt.Sprintf("#{e|<:#{pane_height},%d}", height),
+				tmuxQuote([]string{"resize-pane", "-t", pane, "-y", strconv.Itoa(height)}),
+			}))
+		}
+	}
+	if len(clamps) == 0 {
+		return nil
+	}
+
+	return []string{"set-hook", "-w", "-t", win, "window-layout-changed", strings.Join(clamps, " ; "), ";"}
+}
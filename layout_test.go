@@ -0,0 +1,186 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCheckOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cmds string
+		err  string
+	}{
+		{"splits before layout", "new-window -n w ; split-window ; split-window ; select-layout main-vertical ; resize-pane -x 90 ; select-pane -t w.0", ""},
+		{"layout only", "select-layout even-horizontal ; resize-pane -x 100", ""},
+		{"no commands", "", ""},
+		{"split after select-layout", "new-window ; select-layout main-vertical ; split-window", "split-window comes after select-layout"},
+		{"split after resize-pane", "new-window ; split-window ; resize-pane -x 90 ; split-window", "split-window comes after resize-pane"},
+		{"new-window after layout", "select-layout even-horizontal ; new-window", "new-window comes after select-layout"},
+		{"new-session after layout", "resize-pane -y 20 ; new-session -d", "new-session comes after resize-pane"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkOrder(strings.Fields(tc.cmds))
+			if tc.err == "" && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if tc.err != "" && (err == nil || err.Error() != tc.err) {
+				t.Errorf("got error %v, want %s", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestLayoutsAreRepeatable(t *testing.T) {
+	presets := map[string]bool{"even-horizontal": true, "even-vertical": true, "main-vertical": true}
+	for _, name := range layoutNames() {
+		first := applyLayout("s:w", name, defaultLayoutOptions)
+		if again := applyLayout("s:w", name, defaultLayoutOptions); !reflect.DeepEqual(first, again) {
+			t.Errorf("%s gives %v, and then %v", name, first, again)
+		}
+
+		// Only commands that leave a window with the layout as it is
+		for _, cmd := range splitCommands(first) {
+			switch cmd[0] {
+			case "select-layout":
+				if !presets[cmd[len(cmd)-1]] {
+					t.Errorf("%s selects %s, which isn't a preset", name, cmd[len(cmd)-1])
+				}
+			case "resize-pane", "select-pane", "set-option":
+			default:
+				t.Errorf("%s runs %v, which may change the window when repeated", name, cmd)
+			}
+		}
+	}
+}
+
+func TestRefreshTwiceChangesNothing(t *testing.T) {
+	const applied = "c5a1,200x50,0,0[200x25,0,0,1,200x24,0,26,2]"
+	for _, name := range layoutNames() {
+		fake := &fakeTmux{replies: map[string]string{
+			paneQuery("s:w", "window_width"):       records("200", "200", "200"),
+			paneQuery("s:w", "window_height"):      records("50", "50", "50"),
+			paneQuery("s:w", "window_layout"):      records(applied, applied, applied),
+			optionQuery("s:w", paneCountOption):    "",
+			optionQuery("s:w", layoutOption):       "",
+			optionQuery("s:w", layoutStringOption): "",
+		}}
+		useFake(t, fake)
+
+		p, err := refreshLayout("s", "w", name, false, defaultLayoutOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p.Commands) == 0 {
+			t.Fatalf("%s: nothing to do for a window without the layout", name)
+		}
+
+		// The options that applying the layout stored
+		fake.replies[optionQuery("s:w", layoutOption)] = name
+		fake.replies[optionQuery("s:w", layoutStringOption)] = applied
+		if p, err = refreshLayout("s", "w", name, false, defaultLayoutOptions); err != nil {
+			t.Fatal(err)
+		}
+		if len(p.Commands) != 0 {
+			t.Errorf("%s: refreshing again runs %v", name, p.Commands)
+		}
+
+		if p, err = refreshLayout("s", "w", name, true, defaultLayoutOptions); err != nil {
+			t.Fatal(err)
+		}
+		if want := applyLayout("s:w", name, defaultLayoutOptions); !reflect.DeepEqual(p.Commands, want) {
+			t.Errorf("%s: forced refresh runs %v, want %v", name, p.Commands, want)
+		}
+	}
+}
+
+func TestPaneBaseIndex(t *testing.T) {
+	for _, base := range []int{0, 1} {
+		opts := defaultLayoutOptions
+		opts.baseIndex = base
+
+		if got, want := opts.pane("s:w", 0), "s:w."+strconv.Itoa(base); got != want {
+			t.Errorf("base %d: pane 0 is %s, want %s", base, got, want)
+		}
+		if got, want := opts.pane("s:w", 2), "s:w."+strconv.Itoa(base+2); got != want {
+			t.Errorf("base %d: pane 2 is %s, want %s", base, got, want)
+		}
+
+		// The narrow layout resizes the secondary pane and selects the main pane
+		want := []string{
+			"select-layout", "-t", "s:w", "main-vertical", ";",
+			"resize-pane", "-x", "90", "-y", "20", "-t", "s:w." + strconv.Itoa(base+1), ";",
+			"select-pane", "-t", "s:w." + strconv.Itoa(base), ";",
+		}
+		if got := narrowScreenLayout("s:w", opts); !reflect.DeepEqual(got, want) {
+			t.Errorf("base %d: narrow layout is %v, want %v", base, got, want)
+		}
+	}
+}
+
+func TestRegisterLayout(t *testing.T) {
+	tiled := func(win string, opts layoutOptions) []string {
+		return []string{"select-layout", "-t", win, "tiled", ";"}
+	}
+	if err := RegisterLayout("tiled", tiled); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	t.Cleanup(func() {
+		layoutsMu.Lock()
+		delete(layouts, "tiled")
+		layoutsMu.Unlock()
+	})
+
+	if name, err := chooseLayout("tiled", "200", "50", 3, defaultLayoutOptions); err != nil || name != "tiled" {
+		t.Errorf("chooseLayout(tiled) = %s, %v, want tiled", name, err)
+	}
+	if got := applyLayout("s:w", "tiled", defaultLayoutOptions); got[3] != "tiled" {
+		t.Errorf("applyLayout(tiled) = %q", got)
+	}
+
+	for _, name := range []string{"tiled", "narrow"} {
+		err := RegisterLayout(name, tiled)
+		if want := "layout " + name + " is already registered"; err == nil || err.Error() != want {
+			t.Errorf("RegisterLayout(%s) = %v, want %s", name, err, want)
+		}
+	}
+	if err := RegisterLayout("", tiled); err == nil {
+		t.Error("RegisterLayout with an empty name succeeded")
+	}
+}
+
+func TestLayoutForPanes(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		panes int
+		want  string
+	}{
+		{"narrow", 2, "rows"},
+		{"wide", 2, "columns"},
+		{"rows", 2, "rows"},
+		{"rows", 3, "narrow"},
+		{"columns", 3, "wide"},
+		{"wide", 3, "wide"},
+		{"custom", 2, "custom"},
+		{"custom", 3, "custom"},
+	} {
+		if got := layoutForPanes(tc.name, tc.panes); got != tc.want {
+			t.Errorf("layoutForPanes(%s, %d) = %s, want %s", tc.name, tc.panes, got, tc.want)
+		}
+	}
+}
+
+func TestMinPaneSizeHookTargetsRelative(t *testing.T) {
+	sizes := defaultLayoutOptions
+	sizes.baseIndex = 1
+	cmds := minPaneSizeHook("s:w", 2, sizes, 40, 0)
+
+	want := []string{"set-hook", "-w", "-t", "s:w", "window-layout-changed",
+		"if-shell -F -t .1 '#{e|<:#{pane_width},40}' 'resize-pane -t .1 -x 40' ; " +
+			"if-shell -F -t .2 '#{e|<:#{pane_width},40}' 'resize-pane -t .2 -x 40'", ";"}
+	if !reflect.DeepEqual(cmds, want) {
+		t.Errorf("got hook %q, want %q", cmds, want)
+	}
+}
@@ -1,199 +1,3144 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
-// runTmux invokes tmux with the given commands
-func runTmux(cmds ...[]string) error {
-	var s []string
-	for _, c := range cmds {
-		s = append(s, c...)
-		if s[len(s)-1] != ";" {
-			s = append(s, ";")
+// verbosity controls the informational output; warnings are suppressed when it is
+// below zero, and the executed commands are logged when it is above zero
+var verbosity int
+
+// warnf prints a warning to stderr, unless running quietly
+func warnf(format string, a ...interface{}) {
+	if verbosity >= 0 {
+		fmt.Fprintf(os.Stderr, "warning: "+format+"\n", a...)
+	}
+}
+
+// verbosef prints informational output to stderr when running verbosely
+func verbosef(format string, a ...interface{}) {
+	if verbosity > 0 {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+	}
+}
+
+// plan is the outcome of an action; the tmux commands to run, and the decisions behind them
+type plan struct {
+	Action    string   `json:"action"`
+	Session   string   `json:"session"`
+	Window    string   `json:"window"`
+	Directory string   `json:"directory,omitempty"`
+	Layout    string   `json:"layout,omitempty"`
+	Panes     int      `json:"panes,omitempty"`
+	Commands  []string `json:"-"`
+
+	// Once is the number of panes that run a command once, and close when it exits
+	Once int `json:"once,omitempty"`
+
+	// Startup holds the commands that start programs in the panes, run after Commands
+	Startup []string `json:"-"`
+
+	// Ready holds the new panes that start a shell, which -wait-ready waits for before
+	// running Startup
+	Ready []string `json:"ready,omitempty"`
+
+	// Attach is the session to attach the terminal to after running the commands, if any
+	Attach string `json:"attach,omitempty"`
+
+	// Remove is a directory to remove before running the commands, if any
+	Remove string `json:"remove,omitempty"`
+}
+
+// logAction prints the plan as a JSON object to stderr
+func logAction(p *plan) {
+	json.NewEncoder(os.Stderr).Encode(struct {
+		*plan
+		BatchSize int `json:"batch_size"`
+	}{p, len(splitCommands(p.Commands)) + len(splitCommands(p.Startup))})
+}
+
+// planRecord is a plan as written by -plan-out, with each of its commands as an array
+type planRecord struct {
+	*plan
+	Commands [][]string `json:"commands"`
+	Startup  [][]string `json:"startup,omitempty"`
+}
+
+// writePlans writes the plans to path as a JSON array. The file is replaced by renaming
+// a new one, so that it is never partially written.
+func writePlans(path string, plans []*plan) error {
+	records := make([]planRecord, 0, len(plans))
+	for _, p := range plans {
+		r := planRecord{p, splitCommands(p.Commands), splitCommands(p.Startup)}
+		if r.Commands == nil {
+			r.Commands = [][]string{}
 		}
+		records = append(records, r)
+	}
+
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode plans: %w", err)
 	}
 
-	out, err := exec.Command("tmux", s...).CombinedOutput()
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
 	if err != nil {
-		return fmt.Errorf("failed to run tmux command %v (%s) %w", s, string(out), err)
+		return fmt.Errorf("failed to write plans: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write plans: %w", err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write plans: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write plans: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to write plans: %w", err)
 	}
 
 	return nil
 }
 
-// paneAttr invokes tmux list-panes to fetch a pane attribute, and returns a slice with an entry for each pane
-func paneAttr(attr string) ([]string, error) {
-	out, err := exec.Command("tmux", "list-panes", "-F", "#{"+attr+"}").Output()
+// workspacePanes is the number of panes in a workspace window
+const workspacePanes = 3
+
+// openOptions holds the settings for a new workspace window
+type openOptions struct {
+	env       []string // KEY=VALUE for each pane
+	refresh   []string // KEY=VALUE to set in the session environment before creating the panes
+	layout    string   // the layout name, picked from the window width if empty
+	inPlace   bool     // split and rename the current window instead of creating a new one
+	detached  bool     // create the window without selecting it
+	position  string   // where to insert the window: after or before the current window of the session, or at the end
+	stickyDir bool     // record dirname in the @tmux_workspace_dir window option, for use in key bindings
+	panes     int      // the number of panes, 1 for a single pane without a layout, or workspacePanes
+	shell     string   // the shell command of the new panes, the default-shell of tmux if empty
+
+	// paneEnv holds KEY=VALUE for single panes by index, replacing env for the same KEY
+	paneEnv map[int][]string
+
+	// deferResize postpones the resize-pane commands of the layout of a detached window
+	// until it first becomes the current window, as the panes may not have their final
+	// size before that
+	deferResize bool
+
+	sizes      layoutOptions
+	maxWindows int // refuse to create a window if the session has this many, 0 for no limit
+
+	// minWidth and minHeight are the sizes that the panes are grown back to when
+	// resizing leaves them smaller, 0 for no minimum
+	minWidth, minHeight int
+
+	editor     string // the editor to start in the workspace directory, none if empty
+	editorPane int    // the index of the pane to start the editor in
+
+	paneCommands map[int]string // commands to run, by pane index
+	paneOnce     map[int]string // commands to run instead of a shell, closing the pane when done, by pane index
+	paneScripts  map[int]string // shell scripts to source before the pane commands, by pane index
+	cmdPrefix    string         // prepended to the editor and pane commands, such as a wrapper
+	paneDirs     map[int]string // start directories replacing dirname, by pane index
+	layoutString string         // a tmux layout string to apply instead of the layout, if any
+	paneTitles   map[int]string // pane titles, by pane index
+	paneRoles    map[int]string // values of the @role pane option, by pane index
+	focusPane    int            // the index of the pane to focus, or -1 to keep the focus of the layout
+	focusLast    bool           // focus the pane after the startup commands, instead of before them
+	zoomPane     int            // the index of the pane to zoom once the layout is applied, or -1
+
+	newSession   bool   // create the session with the workspace as its first window, and attach to it
+	client       string // the client to switch to the window, instead of selecting it or attaching, if any
+	switchClient bool   // switch the current client to the window, or attach to it outside tmux
+	replace      string // the id of a window to kill in the same batch, which may have the same name
+	sessionGroup string // with newSession, the existing session or group to add the new session to
+	planned      bool   // the session is created by an earlier plan that a dry run didn't run, and has no windows yet
+	scratch      bool   // record dirname in the @tmux_workspace_scratch window option, so that -kill removes it
+
+	// ssh is the user@host to connect each pane to, when dirname is a directory on that
+	// host. The ssh command is typed into the local shell, which is left when it fails.
+	ssh string
+
+	onCreate string // a tmux command for the after-new-window hook of the window
+
+	windowOptions map[string]string // tmux options to set on the window, by name
+
+	monitorActivity bool // notify about activity in the window
+	monitorBell     bool // notify about bells in the window
+	remainOnExit    bool // keep the panes of the window open when their programs exit
+	sync            bool // send the input of any pane to all panes of the window
+}
+
+// openWindow creates a new tmux window. With opts.inPlace set, the current window
+// is split and renamed instead, and its existing pane is kept as the main pane.
+// With opts.newSession set, the window is created in a new session instead.
+func openWindow(session, window, dirname string, opts openOptions) (*plan, error) {
+	// A remote directory can't be checked, or used as the start directory of the panes,
+	// and a scratch directory is not created for a dry run
+	var err error
+	if opts.ssh == "" && !opts.scratch {
+		info, err := os.Stat(dirname)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", dirname, err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("not a directory: %s", dirname)
+		}
+	}
+
+	// dirArgs gives the start directory arguments for pane i
+	dirArgs := func(i int) []string {
+		if opts.ssh != "" {
+			return nil
+		}
+		if d, ok := opts.paneDirs[i]; ok {
+			return []string{"-c", d}
+		}
+		return []string{"-c", dirname}
+	}
+
+	absWin := fmt.Sprintf("%s:%s", session, window)
+
+	var names []string
+	if opts.newSession {
+		if _, err := queryTmux("has-session", "-t", "="+session); err == nil {
+			return nil, fmt.Errorf("session %s already exists", session)
+		}
+
+		// The windows of a group are shared, so the names are checked in the group
+		if opts.sessionGroup != "" {
+			if _, err := queryTmux("has-session", "-t", "="+opts.sessionGroup); err != nil {
+				return nil, fmt.Errorf("no session to base the group %s on", opts.sessionGroup)
+			}
+			if names, err = windowAttr(opts.sessionGroup, "window_name"); err != nil {
+				return nil, err
+			}
+		}
+	} else if opts.planned {
+		names = nil
+	} else if names, err = windowAttr(session, "window_name"); err != nil {
+		return nil, err
+	}
+	// The name of a replaced window is taken over
+	if opts.replace != "" {
+		names = nil
+	}
+	for _, n := range names {
+		if n == window {
+			return nil, fmt.Errorf("window %s already exists in session %s", window, session)
+		}
+	}
+
+	if !opts.inPlace && opts.maxWindows > 0 && len(names) >= opts.maxWindows {
+		return nil, fmt.Errorf("session %s already has %d windows, the limit is %d", session, len(names), opts.maxWindows)
+	}
+
+	// envArgs gives the environment arguments for pane i
+	envArgs := func(i int) []string {
+		var args []string
+		for _, e := range opts.env {
+			replaced := false
+			for _, pe := range opts.paneEnv[i] {
+				replaced = replaced || strings.SplitN(pe, "=", 2)[0] == strings.SplitN(e, "=", 2)[0]
+			}
+			if !replaced {
+				args = append(args, "-e", e)
+			}
+		}
+		for _, pe := range opts.paneEnv[i] {
+			args = append(args, "-e", pe)
+		}
+		return args
+	}
+
+	// The id of the new window is printed, to kill it if another window takes its name
+	// before the commands target it by name
+	newPanes := []string{"new-window", "-P", "-F", "#{window_id}"}
+	if opts.detached || opts.client != "" {
+		newPanes = append(newPanes, "-d")
+	}
+	switch opts.position {
+	case "after":
+		newPanes = append(newPanes, "-a")
+	case "before":
+		newPanes = append(newPanes, "-b")
+	}
+	// The prefix and the command are sent as a single argument, to be typed as one line
+	prefixed := func(cmd string) string {
+		if opts.cmdPrefix == "" {
+			return cmd
+		}
+		return strings.TrimRight(opts.cmdPrefix, " ") + " " + cmd
+	}
+
+	// shellArgs gives the command of pane i, which tmux runs with the default-shell
+	shellArgs := func(i int) []string {
+		if cmd, ok := opts.paneOnce[i]; ok {
+			return []string{prefixed(cmd), ";"}
+		}
+		if opts.shell != "" {
+			return []string{opts.shell, ";"}
+		}
+		return []string{";"}
+	}
+
+	newPanes = append(append(append(append(newPanes, envArgs(0)...), dirArgs(0)...),
+		"-t", session+":", "-n", window), shellArgs(0)...,
+	)
+
+	// The size decides the layout, and a new session gets the size of the client
+	wwidth, err := paneAttr("", "window_width")
+	var wheight []string
+	if err == nil {
+		wheight, err = paneAttr("", "window_height")
+	}
+	if opts.newSession {
+		var height string
+		wwidth = make([]string, 1)
+		wwidth[0], height, err = clientSize()
+		if err != nil {
+			return nil, err
+		}
+		wheight = []string{height}
+		if opts.sessionGroup != "" {
+			// A grouped session shares the windows of the group, so the workspace is a new window in it
+			newPanes = append([]string{
+				"new-session", "-d", "-s", session, "-t", opts.sessionGroup, "-x", wwidth[0], "-y", height, ";",
+			}, newPanes...)
+		} else {
+			newPanes = append(append(append(append([]string{"new-session", "-d"}, envArgs(0)...), dirArgs(0)...),
+				"-s", session, "-n", window, "-x", wwidth[0], "-y", height), shellArgs(0)...,
+			)
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get attribute %v: %w", attr, err)
+		return nil, err
 	}
 
-	return strings.Split(strings.TrimSpace(string(out)), "\n"), nil
-}
+	if opts.inPlace {
+		// Target the current window by id, as it is renamed by the first command
+		winID, err := paneAttr("", "window_id")
+		if err != nil {
+			return nil, err
+		}
+		absWin = winID[0]
+		newPanes = []string{
+			"rename-window", "-t", absWin, window, ";",
+		}
+	}
+
+	// A new session must exist before its environment can be set
+	if len(opts.refresh) > 0 {
+		var setEnv []string
+		for _, e := range opts.refresh {
+			kv := strings.SplitN(e, "=", 2)
+			setEnv = append(setEnv, "set-environment", "-t", session, kv[0], kv[1], ";")
+		}
+		pos := 0
+		if opts.newSession {
+			for newPanes[pos] != ";" {
+				pos++
+			}
+			pos++
+		}
+		newPanes = append(append(append([]string{}, newPanes[:pos]...), setEnv...), newPanes[pos:]...)
+	}
+
+	for i := 1; i < opts.panes; i++ {
+		newPanes = append(append(append(append(append(newPanes, "split-window"), envArgs(i)...), dirArgs(i)...),
+			"-t", absWin), shellArgs(i)...,
+		)
+	}
+
+	if opts.stickyDir {
+		newPanes = append(newPanes, "set-option", "-w", "-t", absWin, "@tmux_workspace_dir", dirname, ";")
+	}
+	if opts.scratch {
+		newPanes = append(newPanes, "set-option", "-w", "-t", absWin, scratchOption, dirname, ";")
+	}
+	if opts.monitorActivity {
+		newPanes = append(newPanes, "set-option", "-w", "-t", absWin, "monitor-activity", "on", ";")
+	}
+	if opts.monitorBell {
+		newPanes = append(newPanes, "set-option", "-w", "-t", absWin, "monitor-bell", "on", ";")
+	}
+	if opts.remainOnExit {
+		newPanes = append(newPanes, "set-option", "-w", "-t", absWin, "remain-on-exit", "on", ";")
+	}
+	optionNames := make([]string, 0, len(opts.windowOptions))
+	for name := range opts.windowOptions {
+		optionNames = append(optionNames, name)
+	}
+	sort.Strings(optionNames)
+	for _, name := range optionNames {
+		newPanes = append(newPanes, "set-option", "-w", "-t", absWin, name, opts.windowOptions[name], ";")
+	}
+	newPanes = append(newPanes, "set-option", "-w", "-t", absWin, workspaceOption, "1", ";")
+	if opts.panes > 1 && opts.panes != workspacePanes {
+		newPanes = append(newPanes, "set-option", "-w", "-t", absWin, paneCountOption, strconv.Itoa(opts.panes), ";")
+	}
+
+	// A single pane has no layout to apply, and the layout string of a template replaces the layout
+	layout := ""
+	if opts.layoutString != "" {
+		newPanes = append(newPanes, "select-layout", "-t", absWin, opts.layoutString, ";")
+	} else if opts.panes > 1 {
+		layout, err = chooseLayout(opts.layout, wwidth[0], wheight[0], opts.panes, opts.sizes)
+		if err != nil {
+			return nil, err
+		}
+
+		layoutCmds := applyLayout(absWin, layout, opts.sizes)
+		if opts.deferResize && opts.detached {
+			layoutCmds = deferResize(session, absWin, layoutCmds)
+		}
+		newPanes = append(newPanes, layoutCmds...)
+	}
+	newPanes = append(newPanes, minPaneSizeHook(absWin, opts.panes, opts.sizes, opts.minWidth, opts.minHeight)...)
+
+	// Commands are started last to open with the final pane size. With opts.ssh, they
+	// are typed into the remote shells, which are started first.
+	var startup []string
+	if opts.ssh != "" {
+		cmd := sshCommand(opts.ssh, dirname)
+		for i := 0; i < opts.panes; i++ {
+			startup = append(startup, "send-keys", "-t", opts.sizes.pane(absWin, i), cmd, "Enter", ";")
+		}
+	}
+	if opts.editor != "" {
+		startup = append(startup,
+			"send-keys", "-t", opts.sizes.pane(absWin, opts.editorPane), prefixed(opts.editor+" ."), "Enter", ";",
+		)
+	}
+
+	// The kept pane of opts.inPlace runs tmux-workspace, and a pane that runs a command
+	// once never runs a shell
+	var ready []string
+	for i := 0; i < opts.panes; i++ {
+		pane := opts.sizes.pane(absWin, i)
+		if _, ok := opts.paneOnce[i]; !ok && (i > 0 || !opts.inPlace) {
+			ready = append(ready, pane)
+		}
+		if title, ok := opts.paneTitles[i]; ok {
+			newPanes = append(newPanes, "select-pane", "-t", pane, "-T", title, ";")
+		}
+		if role, ok := opts.paneRoles[i]; ok {
+			newPanes = append(newPanes, "set-option", "-p", "-t", pane, "@role", role, ";")
+		}
+		// The pane is closed when its command exits, even if remain-on-exit is on for the window
+		if _, ok := opts.paneOnce[i]; ok {
+			newPanes = append(newPanes, "set-option", "-p", "-t", pane, "remain-on-exit", "off", ";")
+		}
+		// The script is sourced by the shell of the pane, so it can set up the shell itself
+		if script, ok := opts.paneScripts[i]; ok {
+			startup = append(startup, "send-keys", "-t", pane, ". "+shellQuote(script), "Enter", ";")
+		}
+		if cmd, ok := opts.paneCommands[i]; ok {
+			startup = append(startup, "send-keys", "-t", pane, prefixed(cmd), "Enter", ";")
+		}
+	}
+
+	if opts.focusPane >= 0 && opts.focusLast {
+		startup = append(startup, "select-pane", "-t", opts.sizes.pane(absWin, opts.focusPane), ";")
+	} else if opts.focusPane >= 0 {
+		newPanes = append(newPanes, "select-pane", "-t", opts.sizes.pane(absWin, opts.focusPane), ";")
+	}
+
+	if opts.zoomPane >= 0 {
+		newPanes = append(newPanes, "resize-pane", "-Z", "-t", opts.sizes.pane(absWin, opts.zoomPane), ";")
+	}
+
+	// The hook is set on the window once it exists, so it's run right away with -R
+	if opts.onCreate != "" {
+		newPanes = append(newPanes,
+			"set-hook", "-w", "-t", absWin, "after-new-window", opts.onCreate, ";",
+			"set-hook", "-R", "-w", "-t", absWin, "after-new-window", ";",
+		)
+	}
+
+	// send-keys is synchronized too, so the panes are synchronized once their commands are sent
+	if opts.sync {
+		startup = append(startup, "set-option", "-w", "-t", absWin, "synchronize-panes", "on", ";")
+	}
+
+	if opts.replace != "" {
+		newPanes = append([]string{"kill-window", "-t", opts.replace, ";"}, newPanes...)
+	}
+
+	if err := checkOrder(newPanes); err != nil {
+		return nil, fmt.Errorf("invalid command order: %w", err)
+	}
 
-// narrowScreenLayout defines a layout intended for "small" screens
-func narrowScreenLayout(win string) []string {
-	return []string{
-		"select-layout", "-t", win, "main-vertical", ";",
-		"resize-pane", "-x", "90", "-y", "20", "-t", fmt.Sprintf("%s.%d", win, 1), ";",
-		"select-pane", "-t", fmt.Sprintf("%s.%d", win, 0), ";",
+	// A client inside tmux is switched, while a terminal outside is attached after running the commands
+	attach := ""
+	if opts.client != "" {
+		startup = append(startup, "switch-client", "-c", opts.client, "-t", absWin, ";")
+	} else if opts.switchClient && os.Getenv("TMUX") == "" {
+		attach = session
+	} else if opts.switchClient {
+		startup = append(startup, "switch-client", "-t", absWin, ";")
+	} else if opts.newSession && !opts.detached {
+		if os.Getenv("TMUX") != "" {
+			startup = append(startup, "switch-client", "-t", absWin, ";")
+		} else {
+			attach = session
+		}
 	}
+
+	return &plan{
+		Action:    "open",
+		Session:   session,
+		Window:    window,
+		Directory: dirname,
+		Layout:    layout,
+		Panes:     opts.panes,
+		Once:      len(opts.paneOnce),
+		Commands:  newPanes,
+		Startup:   startup,
+		Ready:     ready,
+		Attach:    attach,
+	}, nil
+}
+
+// loginShells are the shells known to start as a login shell when given -l
+var loginShells = map[string]bool{
+	"bash": true,
+	"dash": true,
+	"fish": true,
+	"ksh":  true,
+	"mksh": true,
+	"sh":   true,
+	"zsh":  true,
 }
 
-// wideScreenLayout defines a layout intended for large (4k-ish) screens
-func wideScreenLayout(win string) []string {
-	return []string{
-		"select-layout", "-t", win, "even-horizontal", ";",
-		"resize-pane", "-x", "100", "-t", fmt.Sprintf("%s.%d", win, 0), ";",
-		"select-pane", "-t", fmt.Sprintf("%s.%d", win, 1), ";",
+// loginShellCommand gives the shell command that starts shell as a login shell, or an
+// error if the shell isn't known to take -l
+func loginShellCommand(shell string) (string, error) {
+	if !loginShells[filepath.Base(shell)] {
+		return "", fmt.Errorf("%s is not known to start a login shell with -l", shell)
 	}
+
+	return shell + " -l", nil
 }
 
-// openWindow creates a new tmux window
-func openWindow(session, window, dirname string) ([]string, error) {
-	info, err := os.Stat(dirname)
-	if err != nil {
-		return nil, fmt.Errorf("failed to stat %s: %w", dirname, err)
+// sshCommand gives the shell command that connects to host and starts a login shell in
+// dir, with the history file of the workspace
+func sshCommand(host, dir string) string {
+	remote := "cd " + shellQuote(dir) + " && HISTFILE=" + shellQuote(dir+"/.bash_history") + ` exec "$SHELL" -l`
+	return "ssh -t " + shellQuote(host) + " " + shellQuote(remote)
+}
+
+// shellQuote single quotes a string for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// deferredOption is the window option holding the commands that deferredHook runs when
+// the window first becomes the current window of its session
+const deferredOption = "@tmux_workspace_deferred"
+
+// deferredHook runs the deferred commands of the window that becomes the current one. It
+// has an index of its own to keep the other session-window-changed hooks of the session,
+// and is the same for all windows, so setting it again for another window changes nothing.
+const deferredHook = "session-window-changed[99]"
+
+// deferResize moves the resize-pane commands, and storing the layout string after them,
+// into the deferred commands of the window, which remove themselves to only run once.
+// The deferred commands target the current window instead of win, which may have been
+// renamed, or have another window's name, by the time they run.
+func deferResize(session, win string, cmds []string) []string {
+	var result, deferred []string
+	for _, cmd := range splitCommands(cmds) {
+		if cmd[0] == "resize-pane" || cmd[0] == "set-option" && cmd[len(cmd)-2] == layoutStringOption {
+			deferred = append(deferred, tmuxQuote(untarget(cmd, win)))
+		} else {
+			result = append(append(result, cmd...), ";")
+		}
 	}
-	if !info.IsDir() {
-		return nil, fmt.Errorf("not a directory: %s", dirname)
+	deferred = append(deferred, tmuxQuote([]string{"set-option", "-wu", deferredOption}))
+
+	// run-shell expands the option of the current window to the commands to run
+	run := tmuxQuote([]string{"run-shell", "-C", "#{" + deferredOption + "}"})
+	return append(result,
+		"set-option", "-w", "-t", win, deferredOption, strings.Join(deferred, " ; "), ";",
+		"set-hook", "-t", session, deferredHook, tmuxQuote([]string{"if-shell", "-F", "#{" + deferredOption + "}", run}), ";",
+	)
+}
+
+// untarget removes the target win from cmd, and makes the targets of its panes relative,
+// so that cmd applies to the window of a hook when run from it
+func untarget(cmd []string, win string) []string {
+	var result []string
+	for i := 0; i < len(cmd); i++ {
+		if cmd[i] == "-t" && i+1 < len(cmd) {
+			if cmd[i+1] == win {
+				i++
+				continue
+			}
+			if strings.HasPrefix(cmd[i+1], win+".") {
+				result = append(result, "-t", strings.TrimPrefix(cmd[i+1], win))
+				i++
+				continue
+			}
+		}
+		result = append(result, cmd[i])
 	}
 
+	return result
+}
+
+// flipOptions holds the settings for flipping the layout of a workspace window
+type flipOptions struct {
+	mode  string // how to change the main pane: swap or rotate
+	to    string // the layout to flip to, toggled if empty
+	force bool   // flip to the layout even if the window already has it
+	sizes layoutOptions
+
+	// swapOnly swaps the main pane and reapplies the current layout instead of
+	// changing it, keeping the focus on the pane that was active
+	swapOnly bool
+
+	// noSelect leaves the focus on the pane that was active wherever the flip moves it,
+	// instead of focusing the pane index that was active
+	noSelect bool
+}
+
+// flipLayout flips between the two layouts (wideScreenLayout/narrowScreenLayout), or to
+// the layout named by opts.to if it is non-empty. The main pane is changed by swapping the
+// two first panes, or by rotating all panes if opts.mode is "rotate". Focus stays on the
+// pane index that was active, so the main pane stays focused if it was before.
+func flipLayout(session, window string, opts flipOptions) (*plan, error) {
 	absWin := fmt.Sprintf("%s:%s", session, window)
+	sizes, to := opts.sizes, opts.to
+
+	p := &plan{
+		Action:  "flip",
+		Session: session,
+		Window:  window,
+		Layout:  to,
+	}
+
+	if to != "" && !opts.force && layoutInPlace(absWin, to) {
+		return p, nil
+	}
 
-	if err := runTmux([]string{"has-session", "-t", "" + absWin}); err == nil {
-		return nil, fmt.Errorf("session already exists: %s", absWin)
+	var flipMainPane []string
+	switch opts.mode {
+	case "swap":
+		flipMainPane = []string{"swap-pane"}
+		if opts.noSelect {
+			flipMainPane = append(flipMainPane, "-d")
+		}
+		flipMainPane = append(flipMainPane,
+			"-s", sizes.pane(absWin, sizes.mainPane), "-t", sizes.pane(absWin, sizes.secondaryPane()), ";",
+		)
+	case "rotate":
+		flipMainPane = []string{
+			"rotate-window", "-t", absWin, ";",
+		}
+	default:
+		return nil, fmt.Errorf("unknown flip mode: %s", opts.mode)
 	}
 
-	// TODO: make HISTFILE optional? maybe check if it exists or smth.
-	env := "HISTFILE=" + dirname + "/.bash_history"
-	newPanes := []string{
-		"new-window", "-e", env, "-c", dirname, "-t", session + ":", "-n", window, ";",
-		"split-window", "-e", env, "-c", dirname, "-t", absWin, ";",
-		"split-window", "-e", env, "-c", dirname, "-t", absWin, ";",
+	paneAtBottomAttrs, err := paneAttr(absWin, "pane_at_bottom")
+	if err != nil {
+		return nil, err
+	}
+	if expected := expectedPanes(absWin); len(paneAtBottomAttrs) != expected {
+		return nil, paneCountError(absWin, expected, len(paneAtBottomAttrs))
 	}
 
-	wwidth, err := paneAttr("window_width")
+	paneActiveAttrs, err := paneAttr(absWin, "pane_active")
 	if err != nil {
 		return nil, err
 	}
+	active := 0
+	for i, a := range paneActiveAttrs {
+		if a == "1" {
+			active = i
+		}
+	}
+
+	if len(paneAtBottomAttrs) == 2 {
+		return flipPair(p, absWin, active, opts)
+	}
+
+	if opts.swapOnly {
+		to = currentLayout(session, window)
+		if lookupLayout(to) == nil {
+			return nil, fmt.Errorf("can't swap the main pane of a window with the %s layout", to)
+		}
+
+		// The focus follows the active pane to its new index
+		if active == sizes.mainPane {
+			active = sizes.secondaryPane()
+		} else if active == sizes.secondaryPane() {
+			active = sizes.mainPane
+		}
+	} else if to == "" {
+		to = "narrow"
+		if paneAtBottomAttrs[1] == "0" {
+			to = "wide"
+		}
+	} else if lookupLayout(to) == nil {
+		return nil, fmt.Errorf("unknown layout: %s, expected one of: %s", to, strings.Join(layoutNames(), ", "))
+	}
 
-	if width, err := strconv.Atoi(wwidth[0]); err != nil || width < 300 {
-		return append(newPanes, narrowScreenLayout(absWin)...), nil
+	// The layout selects its own pane, so restore the focus after it
+	p.Layout = to
+	if opts.noSelect {
+		p.Commands = append(flipMainPane, withoutSelect(applyLayout(absWin, to, sizes))...)
+		return p, nil
 	}
+	p.Commands = append(append(flipMainPane, applyLayout(absWin, to, sizes)...),
+		"select-pane", "-t", sizes.pane(absWin, active), ";",
+	)
 
-	return append(newPanes, wideScreenLayout(absWin)...), nil
+	return p, nil
 }
 
-// flipLayout flips between the two layouts (wideScreenLayout/narrowScreenLayout)
-func flipLayout(session, window string) ([]string, error) {
-	absWin := fmt.Sprintf("%s:%s", session, window)
-	pane := absWin + "." + os.Getenv("TMUX_PANE") // TODO: only works for current window
+// flipPair flips a window with two panes between the rows and columns layouts, or to
+// opts.to, and swaps the panes if the focused one isn't the main pane, to promote it
+func flipPair(p *plan, absWin string, active int, opts flipOptions) (*plan, error) {
+	sizes, to := opts.sizes, opts.to
 
-	flipMainPane := []string{
-		"swap-pane", "-s", fmt.Sprintf("%s.%d", absWin, 0), "-t", fmt.Sprintf("%s.%d", absWin, 1), ";",
-		"select-pane", "-t", pane, ";",
+	current := currentLayout(p.Session, p.Window)
+	switch {
+	case opts.swapOnly:
+		to = current
+		if lookupLayout(to) == nil {
+			return nil, fmt.Errorf("can't swap the main pane of a window with the %s layout", to)
+		}
+	case to == "" && current == "rows":
+		to = "columns"
+	case to == "":
+		to = "rows"
+	case lookupLayout(to) == nil:
+		return nil, fmt.Errorf("unknown layout: %s, expected one of: %s", to, strings.Join(layoutNames(), ", "))
 	}
 
-	paneAtBottomAttrs, err := paneAttr("pane_at_bottom")
-	if err != nil {
-		return nil, err
+	var cmds []string
+	if active != sizes.mainPane || opts.swapOnly {
+		cmds = []string{"swap-pane"}
+		if opts.noSelect {
+			cmds = append(cmds, "-d")
+		}
+		cmds = append(cmds, "-s", sizes.pane(absWin, sizes.mainPane), "-t", sizes.pane(absWin, sizes.secondaryPane()), ";")
+	}
+
+	// The layout selects the main pane, where the focused pane is after the swap
+	p.Layout = to
+	if opts.noSelect {
+		p.Commands = append(cmds, withoutSelect(applyLayout(absWin, to, sizes))...)
+		return p, nil
+	}
+	p.Commands = append(cmds, applyLayout(absWin, to, sizes)...)
+
+	return p, nil
+}
+
+// layoutInPlace tells if a window has the named layout, and its panes haven't been
+// rearranged since it was applied
+func layoutInPlace(absWin, name string) bool {
+	stored, err := windowOption(absWin, layoutOption)
+	if err != nil || stored != name {
+		return false
 	}
-	if len(paneAtBottomAttrs) != 3 {
-		return nil, fmt.Errorf("expected 3 panes, got: %d", strconv.Itoa(len(paneAtBottomAttrs)))
+
+	applied, err := windowOption(absWin, layoutStringOption)
+	if err != nil || applied == "" {
+		return false
 	}
 
-	if paneAtBottomAttrs[1] == "0" {
-		return append(flipMainPane, wideScreenLayout(absWin)...), nil
+	current, err := paneAttr(absWin, "window_layout")
+	if err != nil {
+		return false
 	}
 
-	return append(flipMainPane, narrowScreenLayout(absWin)...), nil
+	return current[0] == applied
 }
 
-// usage prints the usage
-func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] [directory]\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "Create a new workspace by providing a directory, or flip between workspace layouts.\n\n")
-	flag.PrintDefaults()
+// currentLayout returns the name of the layout of a workspace window; the stored
+// layout option if set, or else the one recognized from the pane positions
+func currentLayout(session, window string) string {
+	absWin := fmt.Sprintf("%s:%s", session, window)
+
+	if name, err := windowOption(absWin, layoutOption); err == nil && name != "" {
+		return name
+	}
+
+	paneAtBottomAttrs, err := paneAttr(absWin, "pane_at_bottom")
+	if err != nil {
+		return "unknown"
+	}
+
+	switch strings.Join(paneAtBottomAttrs, ",") {
+	case "1,0,1":
+		return "narrow"
+	case "1,1,1":
+		return "wide"
+	case "1,1":
+		return "columns"
+	case "0,1":
+		return "rows"
+	default:
+		return "other"
+	}
 }
 
-// main runs tmux-workspace
-func main() {
-	flag.Usage = usage
-	session := flag.String("session", "", "the target session")
-	window := flag.String("window", "", "the target window")
-	prnt := flag.Bool("print", false, "print the tmux commands instead of executing")
-	flag.Parse()
+// workspaceDir returns the directory of a workspace window; the one stored with
+// -sticky-dir if set, or else the current path of its first pane
+func workspaceDir(session, window string) (string, error) {
+	absWin := fmt.Sprintf("%s:%s", session, window)
 
-	if len(flag.Args()) > 1 {
-		flag.Usage()
-		os.Exit(1)
+	if dir, err := windowOption(absWin, "@tmux_workspace_dir"); err == nil && dir != "" {
+		return dir, nil
 	}
 
-	if os.Getenv("TMUX") == "" {
-		fmt.Fprintf(os.Stderr, "please run inside tmux\n")
-		os.Exit(1)
+	paths, err := paneAttr(absWin, "pane_current_path")
+	if err != nil {
+		return "", err
 	}
 
-	if *session == "" {
-		s, err := paneAttr("session_name")
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "couldn't find session name: %s\n", err.Error())
-			os.Exit(1)
+	return paths[0], nil
+}
+
+// enclosingWorkspace finds a workspace window of the session whose directory contains
+// dir. It returns the window id and its directory, or false if there is none.
+func enclosingWorkspace(session, dir string) (string, string, bool) {
+	ids, dirs := workspaceWindows(session)
+	for i, wdir := range dirs {
+		if rel, err := filepath.Rel(wdir, dir); err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return ids[i], wdir, true
 		}
-		session = &s[0]
 	}
 
-	var commands []string
-	var err error
-	if len(flag.Args()) == 1 {
-		// Create new workspace window for the given directory
-		absPath, err := filepath.Abs(flag.Args()[0])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to get absolute path of %s: %w\n", flag.Args()[0], err)
-			os.Exit(1)
-		}
+	return "", "", false
+}
 
-		if *window == "" {
-			p := strings.ReplaceAll(absPath, ".", "_")
-			window = &p
+// openWorkspace finds a workspace window of the session for dir. It returns the window
+// id, or false if there is none.
+func openWorkspace(session, dir string) (string, bool) {
+	ids, dirs := workspaceWindows(session)
+	for i, wdir := range dirs {
+		if wdir == dir {
+			return ids[i], true
 		}
+	}
 
-		commands, err = openWindow(*session, *window, absPath)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "open failed: %s\n", err.Error())
-			os.Exit(1)
-		}
-	} else {
-		// Flip layout for the given workspace window
-		if *window == "" {
-			w, err := paneAttr("window_name")
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "couldn't find window name: %s\n", err.Error())
-				os.Exit(1)
-			}
-			window = &w[0]
+	return "", false
+}
+
+// workspaceOption is the window option that marks the windows created by openWindow,
+// which -apply-layout doesn't set on other windows like the layout option
+const workspaceOption = "@tmux_workspace"
+
+// isWorkspace tells if a window was created as a workspace
+func isWorkspace(target string) bool {
+	v, err := windowOption(target, workspaceOption)
+	return err == nil && v == "1"
+}
+
+// workspaceWindows lists the ids and directories of the workspace windows of the session.
+// Other windows are skipped, as their panes may be anywhere.
+func workspaceWindows(session string) ([]string, []string) {
+	ids, err := windowAttr(session, "window_id")
+	if err != nil {
+		return nil, nil
+	}
+
+	var resultIDs, dirs []string
+	for _, id := range ids {
+		if !isWorkspace(id) {
+			continue
 		}
 
-		commands, err = flipLayout(*session, *window)
+		wdir, err := workspaceDir(session, id)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to flip layouts: %s\n", err.Error())
-			os.Exit(1)
+			continue
 		}
+		resultIDs, dirs = append(resultIDs, id), append(dirs, wdir)
 	}
 
-	if *prnt {
-		fmt.Println(strings.Join(commands, " "))
-	} else {
-		if err := runTmux(commands); err != nil {
-			fmt.Fprintf(os.Stderr, "failed to run %v: %s\n", commands, err)
+	return resultIDs, dirs
+}
+
+// sessionName returns the name of the session that -session-each creates for dir; its
+// basename, or the basename of its git root with useGitRoot
+func sessionName(dir string, useGitRoot bool) (string, error) {
+	absPath, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path of %s: %w", dir, err)
+	}
+	if root, ok := gitRoot(absPath); ok && useGitRoot {
+		absPath = root
+	}
+
+	// tmux would replace the dots and colons, which separate the window and pane in a target
+	return strings.NewReplacer(".", "_", ":", "_").Replace(filepath.Base(absPath)), nil
+}
+
+// rootMarker is a file that marks a directory as a root for -histfile-root, like a git repository
+const rootMarker = ".tmux-workspace-root"
+
+// gitRoot walks up from dir to the root of the git repository containing it. It returns
+// false if dir isn't in a repository.
+func gitRoot(dir string) (string, bool) {
+	return findRoot(dir, ".git")
+}
+
+// findRoot walks up from dir to the first directory containing one of the given
+// files. It returns false if there is none.
+func findRoot(dir string, names ...string) (string, bool) {
+	for d := dir; ; d = filepath.Dir(d) {
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(d, name)); err == nil {
+				return d, true
+			}
+		}
+		if d == filepath.Dir(d) {
+			return "", false
+		}
+	}
+}
+
+// resolveWindow finds the window that a partial name refers to. An exact name wins,
+// then the names starting with it, then the names containing it. Several matches are
+// an error unless first is set. Window ids, indexes and unmatched names are returned
+// as is, for tmux to resolve.
+func resolveWindow(session, window string, first bool) (string, error) {
+	if strings.HasPrefix(window, "@") {
+		return window, nil
+	}
+	if _, err := strconv.Atoi(window); err == nil {
+		return window, nil
+	}
+
+	names, err := windowAttr(session, "window_name")
+	if err != nil {
+		return "", err
+	}
+
+	var prefixed, contained []string
+	for _, n := range names {
+		switch {
+		case n == window:
+			return n, nil
+		case strings.HasPrefix(n, window):
+			prefixed = append(prefixed, n)
+		case strings.Contains(n, window):
+			contained = append(contained, n)
+		}
+	}
+
+	matches := prefixed
+	if len(matches) == 0 {
+		matches = contained
+	}
+	switch {
+	case len(matches) == 0:
+		return window, nil
+	case len(matches) == 1 || first:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("window %s matches %s, use -first to pick the first", window, strings.Join(matches, ", "))
+	}
+}
+
+// windowLayout returns the tmux layout string of a window, and its number of panes
+func windowLayout(session, window string) (string, int, error) {
+	layouts, err := paneAttr(fmt.Sprintf("%s:%s", session, window), "window_layout")
+	if err != nil {
+		return "", 0, err
+	}
+
+	return layouts[0], len(layouts), nil
+}
+
+// captureTemplate reads the panes of a window into a template, with the directories
+// relative to the one of the first pane. The commands are those the panes were started
+// with; programs started from the shell of a pane can't be captured.
+func captureTemplate(session, window string) (*template, error) {
+	absWin := fmt.Sprintf("%s:%s", session, window)
+
+	// The start command is often empty, so the attributes are queried together
+	format := strings.Join([]string{"#{window_layout}", "#{pane_current_path}", "#{pane_current_command}", "#{pane_start_command}"}, fieldSeparator)
+	out, err := queryTmux("list-panes", "-t", absWin, "-F", format+recordSeparator)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the panes of %s: %w", absWin, err)
+	}
+
+	shell, _ := queryTmux("show-options", "-gv", "default-shell")
+	shell = filepath.Base(strings.TrimSpace(shell))
+
+	t := &template{}
+	base := ""
+	for i, record := range splitRecords(out) {
+		fields := strings.SplitN(record, fieldSeparator, 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected pane attributes: %q", record)
+		}
+		layout, dir, running, cmd := fields[0], fields[1], fields[2], fields[3]
+
+		if i == 0 {
+			t.Layout, base = layout, dir
+		}
+		if rel, err := filepath.Rel(base, dir); err == nil && !strings.HasPrefix(rel, "..") {
+			dir = rel
+		}
+		if dir == "." {
+			dir = ""
+		}
+
+		if cmd == "" && running != shell {
+			warnf("pane %d runs %s, which can't be captured", i, running)
+		}
+
+		t.Panes = append(t.Panes, templatePane{Dir: dir, Command: cmd})
+	}
+
+	return t, nil
+}
+
+// layoutPaneID matches the pane ids in a tmux layout string, which follow the size and
+// position of each pane
+var layoutPaneID = regexp.MustCompile(`(\d+x\d+,\d+,\d+),\d+`)
+
+// normalizeLayout strips the checksum and the pane ids from a tmux layout string, to
+// compare the arrangement of the panes of different windows
+func normalizeLayout(layout string) string {
+	if i := strings.Index(layout, ","); i >= 0 {
+		layout = layout[i+1:]
+	}
+
+	return layoutPaneID.ReplaceAllString(layout, "$1")
+}
+
+// diffTemplate compares a window, as captured by captureTemplate, with the template it
+// should match, and describes the differences in pane count, directories and layout.
+// base is the directory of the first pane of the window, which absolute directories
+// of the template are taken relative to.
+func diffTemplate(live, want *template, base string) []string {
+	var diffs []string
+	if len(want.Panes) > 0 && len(want.Panes) != len(live.Panes) {
+		diffs = append(diffs, fmt.Sprintf("panes: %d in the template, %d in the window", len(want.Panes), len(live.Panes)))
+	}
+
+	for i := 0; i < len(want.Panes) && i < len(live.Panes); i++ {
+		dir := want.Panes[i].Dir
+		if rel, err := filepath.Rel(base, dir); err == nil && filepath.IsAbs(dir) && !strings.HasPrefix(rel, "..") {
+			dir = rel
+		}
+		if dir == "." {
+			dir = ""
+		}
+		if dir != live.Panes[i].Dir {
+			diffs = append(diffs, fmt.Sprintf("pane %d directory: '%s' in the template, '%s' in the window", i, dir, live.Panes[i].Dir))
+		}
+	}
+
+	if want.Layout != "" && normalizeLayout(want.Layout) != normalizeLayout(live.Layout) {
+		diffs = append(diffs, fmt.Sprintf("layout: %s in the template, %s in the window", want.Layout, live.Layout))
+	}
+
+	return diffs
+}
+
+// ellipsis marks a window name shortened by truncateName, like "..." with the dots
+// replaced as in other window names
+const ellipsis = "___"
+
+// minNameLen is the shortest -name-max-len, which leaves room for the ellipsis, a
+// numeric suffix and a character of the name
+const minNameLen = len(ellipsis) + len("-2") + 1
+
+// truncateName shortens name to maxLen characters by keeping its tail, the most specific
+// part of a path, after the ellipsis. A maxLen of 0 keeps the name as is, and the tail
+// is at least a character, even if that makes the name longer than maxLen.
+func truncateName(name string, maxLen int) string {
+	runes := []rune(name)
+	if maxLen <= 0 || len(runes) <= maxLen {
+		return name
+	}
+
+	keep := maxLen - len(ellipsis)
+	if keep < 1 {
+		keep = 1
+	}
+
+	return ellipsis + string(runes[len(runes)-keep:])
+}
+
+// uniqueWindowName returns name, or name with the first free numeric suffix if the
+// session already has a window with that name. With maxLen above 0, the name is
+// truncated to make room for the suffix within maxLen characters.
+func uniqueWindowName(session, name string, maxLen int) (string, error) {
+	names, err := windowAttr(session, "window_name")
+	if err != nil {
+		return "", err
+	}
+
+	taken := map[string]bool{}
+	for _, n := range names {
+		taken[n] = true
+	}
+
+	unique := truncateName(name, maxLen)
+	for i := 2; taken[unique]; i++ {
+		suffix := fmt.Sprintf("-%d", i)
+		if maxLen > 0 {
+			// A suffix longer than the room left still keeps a character of the name
+			keep := maxLen - len(suffix)
+			if keep < len(ellipsis)+1 {
+				keep = len(ellipsis) + 1
+			}
+			unique = truncateName(name, keep) + suffix
+		} else {
+			unique = name + suffix
+		}
+	}
+
+	return unique, nil
+}
+
+// emptiestSession returns the name of the session with the fewest windows, the first
+// one as listed by tmux if several have as few
+func emptiestSession() (string, error) {
+	out, err := queryTmux("list-sessions", "-F", "#{session_windows}"+fieldSeparator+"#{session_name}"+recordSeparator)
+	if err != nil {
+		return "", fmt.Errorf("couldn't list sessions: %w", err)
+	}
+
+	name, fewest := "", 0
+	for _, record := range splitRecords(out) {
+		fields := strings.SplitN(record, fieldSeparator, 2)
+		if len(fields) != 2 {
+			return "", fmt.Errorf("unexpected session attributes: %q", record)
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return "", fmt.Errorf("unexpected window count: %q", record)
+		}
+		if name == "" || n < fewest {
+			name, fewest = fields[1], n
+		}
+	}
+	if name == "" {
+		return "", errors.New("no sessions")
+	}
+
+	return name, nil
+}
+
+// scratchOption is the window option holding the temporary directory of a scratch workspace
+const scratchOption = "@tmux_workspace_scratch"
+
+// scratchPattern is the name of a scratch directory in the temp dir, where os.MkdirTemp
+// replaces the * with a random string
+const scratchPattern = "tmux-workspace-scratch-*"
+
+// busyPanes describes the panes of a window that run something else than the default shell
+func busyPanes(absWin string) ([]string, error) {
+	running, err := paneAttr(absWin, "pane_current_command")
+	if err != nil {
+		return nil, err
+	}
+
+	shell, _ := queryTmux("show-options", "-gv", "default-shell")
+	shell = filepath.Base(strings.TrimSpace(shell))
+
+	var busy []string
+	for i, r := range running {
+		if r != shell {
+			busy = append(busy, fmt.Sprintf("pane %d runs %s", i, r))
+		}
+	}
+
+	return busy, nil
+}
+
+// killWindow kills a workspace window. The directory of a scratch workspace is removed
+// too, as long as it is still in the temp dir, and has the name of a scratch directory.
+func killWindow(session, window string) (*plan, error) {
+	absWin := fmt.Sprintf("%s:%s", session, window)
+
+	dir, err := windowOption(absWin, scratchOption)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &plan{
+		Action:    "kill",
+		Session:   session,
+		Window:    window,
+		Directory: dir,
+		Commands:  []string{"kill-window", "-t", absWin, ";"},
+	}
+
+	// The option can be set by hand, so only a directory named by scratchPattern is removed
+	if dir != "" {
+		switch {
+		case filepath.Dir(dir) != filepath.Clean(os.TempDir()):
+			warnf("not removing %s, it isn't in %s", dir, os.TempDir())
+		case !strings.HasPrefix(filepath.Base(dir), strings.TrimSuffix(scratchPattern, "*")):
+			warnf("not removing %s, it isn't a scratch directory", dir)
+		default:
+			p.Remove = dir
+		}
+	}
+
+	return p, nil
+}
+
+// pinnedOption is the window option that marks a workspace as pinned, for -kill-all to skip it
+const pinnedOption = "@tmux_workspace_pinned"
+
+// pinWindow marks a workspace window as pinned, or removes the mark
+func pinWindow(session, window string, pinned bool) *plan {
+	absWin := fmt.Sprintf("%s:%s", session, window)
+
+	p := &plan{
+		Action:   "pin",
+		Session:  session,
+		Window:   window,
+		Commands: []string{"set-option", "-w", "-t", absWin, pinnedOption, "1", ";"},
+	}
+	if !pinned {
+		p.Action = "unpin"
+		p.Commands = []string{"set-option", "-w", "-u", "-t", absWin, pinnedOption, ";"}
+	}
+
+	return p
+}
+
+// removePane kills a pane of a workspace window, and reapplies its current layout to
+// the remaining panes. Killing the last pane, which closes the window, requires force.
+func removePane(session, window string, index int, force bool, sizes layoutOptions) (*plan, error) {
+	absWin := fmt.Sprintf("%s:%s", session, window)
+
+	indices, err := paneAttr(absWin, "pane_index")
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, i := range indices {
+		found = found || i == strconv.Itoa(index)
+	}
+	if !found {
+		return nil, fmt.Errorf("no pane %d in %s, the panes are: %s", index, absWin, strings.Join(indices, ","))
+	}
+	if len(indices) == 1 && !force {
+		return nil, fmt.Errorf("pane %d is the last pane of %s, use -force to close the window", index, absWin)
+	}
+
+	// A single remaining pane has no layout to reapply, and two panes get the pair layout
+	layout := ""
+	if len(indices) > 2 {
+		layout = layoutForPanes(currentLayout(session, window), len(indices)-1)
+		if lookupLayout(layout) == nil {
+			return nil, fmt.Errorf("can't reapply the %s layout after removing the pane", layout)
+		}
+	}
+
+	cmds := []string{"kill-pane", "-t", fmt.Sprintf("%s.%d", absWin, index), ";"}
+	if len(indices) > 1 {
+		if layout != "" {
+			cmds = append(cmds, applyLayout(absWin, layout, sizes)...)
+		}
+		cmds = append(cmds, "set-option", "-w", "-t", absWin, paneCountOption, strconv.Itoa(len(indices)-1), ";")
+	}
+
+	return &plan{
+		Action:   "remove-pane",
+		Session:  session,
+		Window:   window,
+		Layout:   layout,
+		Panes:    len(indices) - 1,
+		Commands: cmds,
+	}, nil
+}
+
+// paneCountError describes a window that doesn't have the panes of a workspace,
+// which usually means that it has been modified by hand
+func paneCountError(absWin string, expected, count int) error {
+	indices, err := paneAttr(absWin, "pane_index")
+	if err != nil {
+		return fmt.Errorf("expected %d panes in %s, got: %d", expected, absWin, count)
+	}
+
+	return fmt.Errorf("expected %d panes in %s, got: %d (%s)", expected, absWin, count, strings.Join(indices, ","))
+}
+
+// paneCountOption is the window option where the number of panes is stored, when
+// -add-pane or -remove-pane has changed it from workspacePanes
+const paneCountOption = "@tmux_workspace_panes"
+
+// expectedPanes returns the number of panes a workspace window should have
+func expectedPanes(absWin string) int {
+	if v, err := windowOption(absWin, paneCountOption); err == nil && v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+
+	return workspacePanes
+}
+
+// addPane splits a workspace window once more in dirname, and reapplies its current
+// layout to integrate the new pane, or picks one if the window has none. The new pane runs shell, or the default-shell of
+// tmux if it is empty.
+func addPane(session, window, dirname string, env []string, shell string, sizes layoutOptions) (*plan, error) {
+	absWin := fmt.Sprintf("%s:%s", session, window)
+
+	panes, err := paneAttr(absWin, "pane_id")
+	if err != nil {
+		return nil, err
+	}
+
+	// The layout of two panes is mapped back to the one it pairs with, for the third pane.
+	// A window without a layout of its own, such as a single pane, gets one picked from its size.
+	layout := layoutForPanes(currentLayout(session, window), len(panes)+1)
+	if lookupLayout(layout) == nil {
+		width, err := paneAttr(absWin, "window_width")
+		if err != nil {
+			return nil, err
+		}
+		height, err := paneAttr(absWin, "window_height")
+		if err != nil {
+			return nil, err
+		}
+		if layout, err = chooseLayout("", width[0], height[0], len(panes)+1, sizes); err != nil {
+			return nil, err
+		}
+	}
+
+	cmds := []string{"split-window"}
+	for _, e := range env {
+		cmds = append(cmds, "-e", e)
+	}
+	cmds = append(cmds, "-c", dirname, "-t", absWin)
+	if shell != "" {
+		cmds = append(cmds, shell)
+	}
+	cmds = append(append(append(cmds, ";"),
+		applyLayout(absWin, layout, sizes)...),
+		"set-option", "-w", "-t", absWin, paneCountOption, strconv.Itoa(len(panes)+1), ";",
+	)
+
+	return &plan{
+		Action:    "add-pane",
+		Session:   session,
+		Window:    window,
+		Directory: dirname,
+		Layout:    layout,
+		Panes:     len(panes) + 1,
+		Commands:  cmds,
+	}, nil
+}
+
+// refreshLayout reapplies a layout to the existing panes of a workspace window,
+// picking it from the window size if layout is empty
+func refreshLayout(session, window, layout string, force bool, sizes layoutOptions) (*plan, error) {
+	absWin := fmt.Sprintf("%s:%s", session, window)
+
+	wwidth, err := paneAttr(absWin, "window_width")
+	if err != nil {
+		return nil, err
+	}
+	if expected := expectedPanes(absWin); len(wwidth) != expected {
+		return nil, paneCountError(absWin, expected, len(wwidth))
+	}
+	wheight, err := paneAttr(absWin, "window_height")
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err = chooseLayout(layout, wwidth[0], wheight[0], len(wwidth), sizes)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &plan{
+		Action:  "refresh",
+		Session: session,
+		Window:  window,
+		Layout:  layout,
+	}
+	if force || !layoutInPlace(absWin, layout) {
+		p.Commands = applyLayout(absWin, layout, sizes)
+	}
+
+	return p, nil
+}
+
+// applyNamedLayout applies a layout to the panes of any window, which must have the
+// panes that the layout arranges
+func applyNamedLayout(session, window, layout string, sizes layoutOptions) (*plan, error) {
+	absWin := fmt.Sprintf("%s:%s", session, window)
+
+	if lookupLayout(layout) == nil {
+		return nil, fmt.Errorf("unknown layout: %s, expected one of: %s", layout, strings.Join(layoutNames(), ", "))
+	}
+
+	panes, err := paneAttr(absWin, "pane_id")
+	if err != nil {
+		return nil, err
+	}
+	if need := sizes.minPanes(); len(panes) < need {
+		return nil, fmt.Errorf("the %s layout needs at least %d panes, %s has %d", layout, need, absWin, len(panes))
+	}
+
+	return &plan{
+		Action:   "apply-layout",
+		Session:  session,
+		Window:   window,
+		Layout:   layout,
+		Panes:    len(panes),
+		Commands: applyLayout(absWin, layout, sizes),
+	}, nil
+}
+
+// installKeybinding binds key to flip the layout of the current window
+func installKeybinding(key string, noSelect bool) (*plan, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the executable: %w", err)
+	}
+
+	return &plan{
+		Action:   "install-keybinding",
+		Commands: []string{"bind-key", key, "run-shell", flipCommand(exe, noSelect), ";"},
+	}, nil
+}
+
+// flipCommand gives the shell command of the keybinding, which flips the current window
+// with exe. run-shell expands the formats when the key is pressed.
+func flipCommand(exe string, noSelect bool) string {
+	flip := shellQuote(exe) + " -session '#{session_name}' -window '#{window_id}'"
+	if noSelect {
+		flip += " -no-select"
+	}
+
+	return flip
+}
+
+// waitReady polls the panes until they all run the default shell, or the timeout expires
+func waitReady(panes []string, timeout time.Duration) error {
+	if len(panes) == 0 {
+		return nil
+	}
+
+	shell, err := queryTmux("show-options", "-gv", "default-shell")
+	if err != nil {
+		return fmt.Errorf("failed to get the default shell: %w", err)
+	}
+	shell = filepath.Base(strings.TrimSpace(shell))
+
+	for deadline := time.Now().Add(timeout); ; time.Sleep(50 * time.Millisecond) {
+		var waiting []string
+		for _, pane := range panes {
+			cmd, err := queryTmux("display-message", "-p", "-t", pane, "#{pane_current_command}")
+			if err != nil {
+				return fmt.Errorf("failed to get the command of %s: %w", pane, err)
+			}
+			if cmd = strings.TrimSpace(cmd); cmd != shell {
+				waiting = append(waiting, pane+": "+cmd)
+			}
+		}
+		if len(waiting) == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("panes not ready after %s: %s", timeout, strings.Join(waiting, ", "))
+		}
+	}
+}
+
+// executeOptions holds the settings for executing a plan
+type executeOptions struct {
+	prnt        bool          // print the commands instead of running them
+	describe    bool          // explain what the commands do instead of running them
+	plans       *[]*plan      // collect the plans here instead of running them, if not nil
+	logJSON     bool          // log the plan as a JSON object
+	waitReady   bool          // wait for the shells of the panes before running the startup commands
+	waitTimeout time.Duration // how long to wait for the shells
+
+	inspectOnError bool // select the partially created window when the commands fail
+
+	sizes layoutOptions // the layout sizes, for describe
+
+	// controlMode is a file, such as a FIFO read by a tmux control mode client, to write the
+	// commands to instead of running them
+	controlMode string
+
+	sourceFile bool // run the commands with source-file, instead of on the command line
+}
+
+// inspect selects the window of a plan whose commands failed half-way, and prints its target
+func inspect(p *plan) {
+	target := p.Session + ":" + p.Window
+	if _, err := runTmux([]string{"select-window", "-t", target}); err != nil {
+		warnf("no window to inspect at %s", target)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "partially created workspace: %s\n", target)
+}
+
+// logOutput prints the output of tmux when running verbosely
+func logOutput(out string) {
+	if out = strings.TrimSpace(out); out != "" {
+		verbosef("tmux: %s", out)
+	}
+}
+
+// removeDir removes the directory of a plan, if any
+func removeDir(p *plan) error {
+	if p.Remove == "" {
+		return nil
+	}
+
+	verbosef("remove %s", p.Remove)
+	if err := os.RemoveAll(p.Remove); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", p.Remove, err)
+	}
+
+	return nil
+}
+
+// maxAttempts is the number of times a workspace is planned and created when other
+// windows keep taking its name
+const maxAttempts = 3
+
+// errWindowRace is returned by execute when another window got the name of a new
+// workspace window between planning and running the commands
+var errWindowRace = errors.New("another window was created with the same name")
+
+// raceWindow tells if the commands of an open plan failed because another window got
+// the name of the new window, and returns the id of the new window from the output
+func raceWindow(p *plan, out string) (string, bool) {
+	if !strings.Contains(out, "can't find window: "+p.Window) {
+		return "", false
+	}
+
+	names, err := windowAttr(p.Session, "window_name")
+	if err != nil {
+		return "", false
+	}
+	count := 0
+	for _, n := range names {
+		if n == p.Window {
+			count++
+		}
+	}
+	if count < 2 {
+		return "", false
+	}
+
+	id := strings.SplitN(strings.TrimSpace(out), "\n", 2)[0]
+	return id, strings.HasPrefix(id, "@")
+}
+
+// openRetrying plans a workspace with planOpen and executes the plan, planning again up
+// to maxAttempts times when another window takes its name in between. Planning again
+// picks the next free name where names are deduplicated, and fails with the name taken
+// otherwise.
+func openRetrying(planOpen func() (*plan, error), opts executeOptions) (*plan, error) {
+	for attempt := 1; ; attempt++ {
+		p, err := planOpen()
+		if err != nil {
+			return nil, err
+		}
+
+		err = execute(p, opts)
+		if !errors.Is(err, errWindowRace) || attempt == maxAttempts {
+			return p, err
+		}
+		verbosef("retrying: %s", err.Error())
+	}
+}
+
+// execute prints or runs the commands of a plan
+func execute(p *plan, opts executeOptions) error {
+	if opts.plans != nil {
+		*opts.plans = append(*opts.plans, p)
+	} else if opts.describe {
+		fmt.Println(describePlan(p, opts.sizes))
+	} else if len(p.Commands)+len(p.Startup) == 0 {
+		verbosef("%s: nothing to do", p.Action)
+	} else if opts.prnt {
+		if queryLog != nil {
+			for _, q := range *queryLog {
+				fmt.Println("# " + q)
+			}
+			*queryLog = nil
+		}
+		if p.Remove != "" {
+			fmt.Println("# remove " + p.Remove)
+		}
+		commands := append(p.Commands, p.Startup...)
+		if p.Attach != "" {
+			commands = append(commands, "attach-session", "-t", p.Attach, ";")
+		}
+		fmt.Println(formatCommands(commands))
+	} else if opts.controlMode != "" {
+		if err := removeDir(p); err != nil {
+			return err
+		}
+		if p.Attach != "" {
+			warnf("not attaching to %s in control mode", p.Attach)
+		}
+
+		if err := writeControlMode(opts.controlMode, append(p.Commands, p.Startup...)); err != nil {
+			return err
+		}
+	} else {
+		// Killing the window of this process may end it before the commands return
+		if err := removeDir(p); err != nil {
+			return err
+		}
+
+		commands := p.Commands
+		if !opts.waitReady {
+			commands = append(commands, p.Startup...)
+		}
+		run := runTmux
+		if opts.sourceFile {
+			run = sourceTmux
+		}
+
+		verbosef("tmux %s", strings.Join(commands, " "))
+		out, err := run(commands)
+		logOutput(out)
+		if err != nil {
+			// The other window is left alone, and the new one is killed to try again
+			if id, ok := raceWindow(p, out); ok && p.Action == "open" {
+				verbosef("tmux kill-window -t %s", id)
+				if _, err := runTmux([]string{"kill-window", "-t", id}); err != nil {
+					warnf("couldn't kill the new window %s: %s", id, err.Error())
+				}
+				return fmt.Errorf("%w: %s in session %s", errWindowRace, p.Window, p.Session)
+			}
+			if opts.inspectOnError && p.Action == "open" {
+				inspect(p)
+			}
+			return fmt.Errorf("failed to run %v: %w", commands, err)
+		}
+
+		if opts.waitReady && len(p.Startup) > 0 {
+			if err := waitReady(p.Ready, opts.waitTimeout); err != nil {
+				warnf("%s", err.Error())
+			}
+
+			verbosef("tmux %s", strings.Join(p.Startup, " "))
+			out, err := run(p.Startup)
+			logOutput(out)
+			if err != nil {
+				if opts.inspectOnError && p.Action == "open" {
+					inspect(p)
+				}
+				return fmt.Errorf("failed to run %v: %w", p.Startup, err)
+			}
+		}
+
+		// tmux may refuse to split small windows without failing the whole batch. The
+		// panes of -pane-cmd-once may have closed already, and are left out of the count.
+		if p.Action == "open" {
+			panes, err := paneAttr(p.Session+":"+p.Window, "pane_id")
+			if err != nil && p.Once < p.Panes {
+				warnf("couldn't verify the new workspace: %s", err.Error())
+			} else if err == nil && len(panes) < p.Panes-p.Once || len(panes) > p.Panes {
+				warnf("expected %d panes in the new workspace, got: %d", p.Panes, len(panes))
+			}
+		}
+
+		// Attaching returns when the client detaches
+		if p.Attach != "" {
+			verbosef("tmux attach-session -t %s", p.Attach)
+			cmd := exec.Command("tmux", "attach-session", "-t", p.Attach)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("failed to attach to %s: %w", p.Attach, err)
+			}
+		}
+	}
+
+	if opts.logJSON {
+		logAction(p)
+	}
+
+	return nil
+}
+
+// usage prints the usage
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] [directory...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Create new workspaces by providing directories, or flip between workspace layouts.\n\n")
+	flag.PrintDefaults()
+}
+
+// main runs tmux-workspace
+func main() {
+	flag.Usage = usage
+	session := flag.String("session", "", "the target session")
+	window := flag.String("window", "", "the target window")
+	planOut := flag.String("plan-out", "", "write the plans of all actions to the given file as JSON, instead of running them")
+	describe := flag.Bool("describe", false, "explain in plain English what would be done, instead of doing it")
+	prnt := flag.Bool("print", false, "print the tmux commands instead of executing")
+	inPlace := flag.Bool("in-place", false, "turn the current window into a workspace instead of creating a new window")
+	force := flag.Bool("force", false, "allow -in-place for a window that already has multiple panes, and reapply a layout that is in place")
+	layout := flag.String("layout", "", "the layout to use (narrow or wide, or rows or columns for 2 panes), picked from the window width if empty")
+	stickyDir := flag.Bool("sticky-dir", false, "store the directory in the window option @tmux_workspace_dir for later splits")
+	flipMode := flag.String("flip-mode", "swap", "how to change the main pane when flipping: swap or rotate")
+	showDir := flag.Bool("dir", false, "print the directory of a workspace window")
+	showLayout := flag.Bool("current-layout", false, "print the name of the current layout of a workspace")
+	flipTo := flag.String("flip-to", "", "flip to the given layout instead of toggling")
+	deferResize := flag.Bool("defer-resize", false, "resize the panes of a new workspace created in the background when its window is first selected")
+	maxWindows := flag.Int("max-windows", 0, "refuse to create a workspace in a session with this many windows (default unlimited, or max_windows from the config)")
+	editor := flag.String("editor", os.Getenv("EDITOR"), "the editor to start in a new workspace, none if empty")
+	editorPane := flag.Int("editor-pane", 0, "the index of the pane to start the editor in")
+	printQueries := flag.Bool("print-queries", false, "with -print, also print the queries made to tmux and their results")
+	logJSON := flag.Bool("log-json", false, "log each action as a JSON object to stderr")
+	quiet := flag.Bool("quiet", false, "suppress warnings and other non-error output")
+	verbose := flag.Bool("verbose", false, "log the tmux commands that are run")
+	narrowWidth := flag.Int("narrow-width", 0, "the width of the secondary panes in the narrow layout (default from the config, or 90)")
+	narrowPercent := flag.Int("narrow-percent", 0, "the width of the secondary panes in the narrow layout, in percent of the window")
+	wideMainWidth := flag.Int("wide-main-width", 0, "the width of the main pane in the wide layout (default from the config, or 100)")
+	wideMainPercent := flag.Int("wide-main-percent", 0, "the width of the main pane in the wide layout, in percent of the window")
+	useGitRoot := flag.Bool("git-root", false, "create the workspace in the root of the git repository containing the directory")
+	bindKey := flag.String("install-keybinding", "", "bind the given key to flip the layout of the current window")
+	clone := flag.Bool("clone", false, "create a new workspace for the directory and layout of an existing one")
+	decision := flag.String("decision", "width", "how the layout of a new workspace is picked: from the wide_threshold window width, or from the aspect, the window width divided by the height")
+	aspectCutoff := flag.Float64("aspect-cutoff", defaultLayoutOptions.aspectCutoff, "with -decision aspect, the aspect from which the wide layout is picked")
+	resizePane := flag.Int("resize-pane", -1, "the index of the pane that the layouts resize, instead of the secondary pane in the narrow layout and the main pane in the wide one")
+	mainPane := flag.Int("main-pane", -1, "the index of the main pane (default from the config, or 0)")
+	readStdin := flag.Bool("stdin", false, "read the directories to create workspaces for from stdin, one per line")
+	waitReadyFlag := flag.Bool("wait-ready", false, "wait for the shells of new panes to start before sending commands to them")
+	inspectOnError := flag.Bool("inspect-on-error", false, "select the partially created window when creating a workspace fails")
+	waitTimeout := flag.Duration("wait-timeout", 2*time.Second, "how long to wait for the shells with -wait-ready")
+	newSession := flag.String("new-session", "", "create a new session with the given name for the workspace, and attach to it")
+	sessionEach := flag.Bool("session-each", false, "create a new session for each directory, named after its basename, instead of a window in the target session")
+	noEnv := flag.Bool("no-env", false, "start the new panes with the environment of tmux as is, ignoring HISTFILE, -env, -pane-env, -env-from-parent and the env of the config")
+	histfileRoot := flag.Bool("histfile-root", false, "share HISTFILE in the root of the git repository, or the directory with a "+rootMarker+" file")
+	scratch := flag.Bool("scratch", false, "create a workspace in a new temporary directory, which -kill removes")
+	kill := flag.Bool("kill", false, "kill a workspace window")
+	killAll := flag.Bool("kill-all", false, "kill all workspace windows of the session, except the pinned ones")
+	forcePinned := flag.Bool("force-pinned", false, "with -kill-all, kill the pinned workspace windows too")
+	pin := flag.Bool("pin", false, "pin a workspace window, so that -kill-all skips it")
+	unpin := flag.Bool("unpin", false, "unpin a pinned workspace window")
+	panes := flag.Int("panes", workspacePanes, fmt.Sprintf("the number of panes in a new workspace, 1, 2 or %d", workspacePanes))
+	monitorActivity := flag.Bool("monitor-activity", false, "turn on monitor-activity for a new workspace window")
+	reopen := flag.Bool("reopen", false, "kill a workspace window and create it again for the same directory, requiring -force if its panes run programs")
+	statusStyle := flag.String("status-style", "", "set window-status-style of a new workspace window, such as fg=green, to tell it apart in the status line")
+	windowStyle := flag.String("window-style", "", "set window-style of a new workspace window, such as bg=colour235, for the default style of its panes")
+	validateConfig := flag.Bool("validate-config", false, "check the config file, and exit")
+	glob := flag.String("glob", "", "create a workspace for each directory matching the pattern, with a leading ~ expanded, skipping the ignore patterns")
+	commandPrefix := flag.String("command-prefix", "", "prepend a command to the editor and pane commands of a new workspace, such as \"direnv exec .\"")
+	warnNested := flag.Bool("warn-nested", false, "warn if the directory of a new workspace is inside the directory of an open workspace")
+	zoom := flag.Int("zoom", -1, "zoom the pane with the given index of a new workspace, once the layout is applied (default no zoom)")
+	layoutFrom := flag.String("layout-from-window", "", "apply the tmux layout of the given window to a new workspace, which must have as many panes")
+	sync := flag.Bool("sync", false, "turn on synchronize-panes for a new workspace window, to type into all its panes at once")
+	monitorBell := flag.Bool("monitor-bell", false, "turn on monitor-bell for a new workspace window")
+	remainOnExit := flag.Bool("remain-on-exit", false, "turn on remain-on-exit for a new workspace window, to keep the panes open when their programs exit")
+	hostInSession := flag.Bool("host-in-session", false, "prefix the name of a new session with the short hostname")
+	pick := flag.Bool("pick", false, "list the project directories in the given directories, or project_dirs from the config, to pick from")
+	sourceFile := flag.Bool("source-file", false, "run the commands from a temporary file with tmux source-file, instead of on the command line, which has a length limit")
+	controlMode := flag.String("control-mode", "", "write the commands to the given file, such as the input FIFO of a tmux control mode client, instead of running them")
+	noSelect := flag.Bool("no-select", false, "leave the focus on the pane that was active when flipping, wherever it moves")
+	swapOnly := flag.Bool("swap-only", false, "swap the main pane with the secondary one, keeping the current layout")
+	heightOffset := flag.Int("height-offset", -1, "rows added to the height of the upper secondary pane in the narrow layout (default 1 if pane-border-status is on, otherwise 0)")
+	showConfigFlag := flag.Bool("show-config", false, "print the settings in effect as YAML, with their sources if -verbose is given")
+	sshTarget := flag.String("ssh", "", "create a workspace for a directory on a remote host, given as [user@]host:directory, with each pane connected by ssh")
+	sessionGroup := flag.String("session-group", "", "with -new-session, add the new session to the group of the given session")
+	addPaneFlag := flag.Bool("add-pane", false, "split a workspace window once more in its directory, and reapply its layout")
+	removePaneIndex := flag.Int("remove-pane", -1, "kill the pane with the given index in a workspace window, and reapply its layout")
+	focus := flag.String("focus", "none", "the window to select after creating workspaces for multiple directories: first, last or none")
+	applyLayoutName := flag.String("apply-layout", "", "apply the given layout to the panes of an existing window")
+	openOrFlip := flag.Bool("open-or-flip", false, "select and flip the workspace window of the directory if one is open in the session, or create it")
+	balanceSessions := flag.Bool("balance-sessions", false, "create workspaces in the session with the fewest windows unless -session is given")
+	useDefaultSession := flag.Bool("use-default-session", false, "create workspaces in default_session from the config unless -session is given, creating it if needed")
+	first := flag.Bool("first", false, "pick the first of the windows that a partial -window name matches")
+	onCreate := flag.String("on-create", "", "a tmux command to set as the after-new-window hook of a new workspace window, and run")
+	diffName := flag.String("diff-template", "", "compare the pane count, directories and layout of a window with the given template, and exit with 1 if they differ")
+	exportName := flag.String("export-template", "", "capture the panes of a window as a template with the given name in the config file")
+	interactive := flag.Bool("interactive", false, "pick the directory of a new workspace from a menu of the recent ones and project_dirs, when given none")
+	loginShell := flag.Bool("login-shell", false, "start the shells of new panes as login shells, with the default-shell of tmux and -l")
+	all := flag.Bool("all", false, "flip all workspace windows of the session, or apply -apply-layout to all its windows, skipping those without matching panes")
+	minPaneSize := flag.String("min-pane-size", "", "grow the panes of a new workspace back to at least WIDTHxHEIGHT when resized smaller, 0 for no minimum in a direction (default no minimum)")
+	nameMaxLen := flag.Int("name-max-len", 0, "truncate the window names derived from directories to this many characters, keeping the end (default unlimited)")
+	switchFlag := flag.Bool("switch", false, "switch the client to a new workspace in another session than the current one")
+	client := flag.String("client", "", "switch the given tmux client to a new workspace, as listed by tmux list-clients, instead of selecting it for the current one")
+	position := flag.String("position", "end", "where to insert a new workspace window: after or before the current window, or at the end")
+	refresh := flag.Bool("refresh", false, "reapply the layout to the panes of an existing workspace")
+	configPath := flag.String("config", defaultConfigPath(), "the config file")
+	templateName := flag.String("template", "", "the template from the config file to use for a new workspace")
+	var cliEnv stringList
+	flag.Var(&cliEnv, "env", "set an environment variable (KEY=VALUE) in the new panes, can be repeated")
+	var roles stringList
+	flag.Var(&roles, "pane-role", "set the @role pane option of a new pane (INDEX:NAME), can be repeated")
+	var inheritEnv stringList
+	flag.Var(&inheritEnv, "env-from-parent", "pass an environment variable (KEY) of this process on to the new panes, can be repeated")
+	var paneEnvFlags stringList
+	flag.Var(&paneEnvFlags, "pane-env", "set an environment variable in a single new pane (INDEX:KEY=VALUE), replacing -env for the same KEY, can be repeated")
+	var onceCommands stringList
+	flag.Var(&onceCommands, "pane-cmd-once", "run a command in a new pane instead of a shell (INDEX:COMMAND), closing the pane when it exits, can be repeated")
+	var scriptFlags stringList
+	flag.Var(&scriptFlags, "pane-script", "source a shell script in a new pane (INDEX:PATH), relative to the workspace directory, before the pane command, can be repeated")
+	var refreshVars stringList
+	flag.Var(&refreshVars, "refresh-env", "set an environment variable (KEY) of this process in the session environment, for the new panes and later ones, can be repeated")
+	flag.Parse()
+
+	if (*interactive || *exportName != "" || *diffName != "" || *applyLayoutName != "" || *removePaneIndex >= 0 || *addPaneFlag || *sshTarget != "" || *scratch || *kill || *killAll || *pin || *unpin || *reopen || *refresh || *showLayout || *showDir || *flipTo != "" || *clone || *bindKey != "" || *readStdin) && len(flag.Args()) > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *swapOnly && (*flipMode != "swap" || *flipTo != "") {
+		fmt.Fprintf(os.Stderr, "-swap-only can't be combined with -flip-mode rotate or -flip-to\n")
+		os.Exit(1)
+	}
+
+	if *quiet && *verbose {
+		fmt.Fprintf(os.Stderr, "-quiet and -verbose can't be combined\n")
+		os.Exit(1)
+	}
+	if *quiet {
+		verbosity = -1
+	} else if *verbose {
+		verbosity = 1
+	}
+
+	if *printQueries {
+		queryLog = &[]string{}
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	if *validateConfig {
+		if err := cfg.validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid config %s: %s\n", *configPath, err.Error())
+			os.Exit(1)
+		}
+		if verbosity >= 0 {
+			fmt.Fprintf(os.Stderr, "%s is valid\n", *configPath)
+		}
+		return
+	}
+	ts, err := tmuxSettings()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	cfg.mergeTmux(ts)
+	queryTimeout, batchTimeout = cfg.timeouts()
+	if queryTimeout < 0 || batchTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "invalid timeout in the config, expected a positive duration\n")
+		os.Exit(1)
+	}
+
+	// The default session is created like with -new-session when it doesn't exist, with
+	// the first of the workspaces, and the others are opened as windows in it. Whether it
+	// is created or not, the client is switched to it. The name is looked up as it is, so
+	// it can't get the hostname prefix of a new session.
+	useDefault, createDefault, sessionPlanned := false, false, false
+	if *useDefaultSession && *session == "" && *newSession == "" {
+		if cfg.DefaultSession == nil || *cfg.DefaultSession == "" {
+			fmt.Fprintf(os.Stderr, "-use-default-session needs default_session in the config\n")
+			os.Exit(1)
+		}
+		if *hostInSession {
+			fmt.Fprintf(os.Stderr, "-host-in-session can't be combined with -use-default-session\n")
+			os.Exit(1)
+		}
+		useDefault = true
+		name := *cfg.DefaultSession
+		if _, err := queryTmux("has-session", "-t", "="+name); err != nil {
+			newSession, createDefault = &name, true
+		} else {
+			session = &name
+		}
+	}
+
+	// The session is picked once the workspaces to create are known
+	balance := *balanceSessions && *session == "" && *newSession == ""
+
+	if *newSession != "" {
+		if *inPlace {
+			fmt.Fprintf(os.Stderr, "-new-session and -in-place can't be combined\n")
+			os.Exit(1)
+		}
+		session = newSession
+
+		if *hostInSession {
+			host, err := os.Hostname()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "couldn't find the hostname: %s\n", err.Error())
+				os.Exit(1)
+			}
+			// The short hostname has no dots, which tmux would replace in the name
+			s := strings.SplitN(host, ".", 2)[0] + "-" + *newSession
+			session = &s
+		}
+	} else if *hostInSession || *sessionGroup != "" {
+		fmt.Fprintf(os.Stderr, "-host-in-session and -session-group require -new-session\n")
+		os.Exit(1)
+	}
+	if strings.ContainsAny(*sessionGroup, ":.") {
+		fmt.Fprintf(os.Stderr, "invalid session group name: %s\n", *sessionGroup)
+		os.Exit(1)
+	}
+
+	if *pick {
+		roots := flag.Args()
+		if len(roots) == 0 {
+			for _, d := range cfg.ProjectDirs {
+				roots = append(roots, os.ExpandEnv(d))
+			}
+		}
+		if len(roots) == 0 {
+			fmt.Fprintf(os.Stderr, "-pick needs directories, or project_dirs in the config\n")
+			os.Exit(1)
+		}
+
+		candidates, err := pickCandidates(roots, cfg.ignorePatterns())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		for _, c := range candidates {
+			fmt.Println(c)
+		}
+		return
+	}
+
+	sizes := cfg.layoutOptions()
+	for _, s := range []struct {
+		name           string
+		width, percent int
+	}{
+		{"narrow", *narrowWidth, *narrowPercent},
+		{"wide-main", *wideMainWidth, *wideMainPercent},
+	} {
+		if s.width != 0 && s.percent != 0 {
+			fmt.Fprintf(os.Stderr, "-%s-width and -%s-percent can't be combined\n", s.name, s.name)
+			os.Exit(1)
+		}
+		if s.percent < 0 || s.percent >= 100 {
+			fmt.Fprintf(os.Stderr, "invalid -%s-percent: %d\n", s.name, s.percent)
+			os.Exit(1)
+		}
+	}
+	if *narrowWidth != 0 {
+		sizes.narrowWidth = *narrowWidth
+	}
+	if *wideMainWidth != 0 {
+		sizes.wideMainWidth = *wideMainWidth
+	}
+	sizes.narrowPercent = *narrowPercent
+	sizes.wideMainPercent = *wideMainPercent
+	if *mainPane >= 0 {
+		sizes.mainPane = *mainPane
+	}
+	if *heightOffset >= 0 {
+		sizes.heightOffset = *heightOffset
+	} else if status, err := paneAttr("", "pane-border-status"); err == nil && status[0] != "" && status[0] != "off" {
+		// The border status line takes a row from the pane above it
+		sizes.heightOffset = 1
+	}
+	if base, err := paneAttr("", "pane-base-index"); err == nil {
+		sizes.baseIndex, _ = strconv.Atoi(base[0])
+	}
+	if sizes.mainPane < 0 || sizes.mainPane >= workspacePanes {
+		fmt.Fprintf(os.Stderr, "invalid main pane %d, the workspace has %d panes\n", sizes.mainPane, workspacePanes)
+		os.Exit(1)
+	}
+	if *resizePane < -1 || *resizePane >= workspacePanes {
+		fmt.Fprintf(os.Stderr, "invalid -resize-pane %d, the workspace has %d panes\n", *resizePane, workspacePanes)
+		os.Exit(1)
+	}
+	sizes.resizePane = *resizePane
+
+	if *decision != "width" && *decision != "aspect" {
+		fmt.Fprintf(os.Stderr, "invalid -decision %s, expected width or aspect\n", *decision)
+		os.Exit(1)
+	}
+	if *aspectCutoff <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid -aspect-cutoff %g, expected a positive number\n", *aspectCutoff)
+		os.Exit(1)
+	}
+	sizes.decision, sizes.aspectCutoff = *decision, *aspectCutoff
+
+	var minWidth, minHeight int
+	if *minPaneSize != "" {
+		var err error
+		minWidth, minHeight, err = parseSize(*minPaneSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -min-pane-size: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	panesSet := false
+	flag.Visit(func(f *flag.Flag) { panesSet = panesSet || f.Name == "panes" })
+	if cfg.Panes != nil && !panesSet {
+		*panes = *cfg.Panes
+	}
+	if *panes < 1 || *panes > workspacePanes {
+		fmt.Fprintf(os.Stderr, "invalid -panes %d, a workspace has 1, 2 or %d panes\n", *panes, workspacePanes)
+		os.Exit(1)
+	}
+	if *panes > 1 && sizes.minPanes() > *panes {
+		fmt.Fprintf(os.Stderr, "the main pane and the resized pane need %d panes, the workspace has %d\n", sizes.minPanes(), *panes)
+		os.Exit(1)
+	}
+
+	tmpl, err := cfg.template(*templateName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	// An exported template has the pane count of the window it was captured from
+	if len(tmpl.Panes) > 0 && !panesSet {
+		*panes = len(tmpl.Panes)
+	}
+
+	// Layouts from the config are applied with their built-in layout
+	named, _, err := cfg.layout(*layout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid layout: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if named != nil && len(named.Panes) > *panes {
+		fmt.Fprintf(os.Stderr, "layout %s names %d panes, the workspace has %d\n", *layout, len(named.Panes), *panes)
+		os.Exit(1)
+	}
+	if def, ok, err := cfg.layout(*flipTo); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid layout: %s\n", err.Error())
+		os.Exit(1)
+	} else if ok {
+		flipTo = &def.Layout
+	}
+
+	if *showConfigFlag {
+		set := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		fromFlag := func(name string, source string) string {
+			if set[name] {
+				return "flag"
+			}
+			return source
+		}
+		unset := func(settings) bool { return false }
+
+		ignore, ignoreSource := defaultIgnore, "default"
+		if cfg.Ignore != nil {
+			ignore, ignoreSource = cfg.Ignore, "file"
+		}
+		dirsSource := "default"
+		if cfg.ProjectDirs != nil {
+			dirsSource = "file"
+		}
+		heightSource := "default"
+		if sizes.heightOffset > 0 {
+			heightSource = "pane-border-status"
+		}
+		editorSource := "default"
+		if os.Getenv("EDITOR") != "" {
+			editorSource = "env EDITOR"
+		}
+		maxWindows := *maxWindows
+		if maxWindows == 0 && cfg.MaxWindows != nil {
+			maxWindows = *cfg.MaxWindows
+		}
+		gitRootSource := cfg.source(func(s settings) bool { return s.GitRoot != nil })
+		if *useGitRoot {
+			gitRootSource = "flag"
+		}
+
+		defaultSession := ""
+		if cfg.DefaultSession != nil {
+			defaultSession = *cfg.DefaultSession
+		}
+
+		values := []resolvedValue{
+			{"wide_threshold", sizes.wideThreshold, cfg.source(func(s settings) bool { return s.WideThreshold != nil })},
+			{"narrow_width", sizes.narrowWidth, fromFlag("narrow-width", cfg.source(func(s settings) bool { return s.NarrowWidth != nil }))},
+			{"narrow_percent", sizes.narrowPercent, fromFlag("narrow-percent", cfg.source(unset))},
+			{"narrow_height", sizes.narrowHeight, cfg.source(func(s settings) bool { return s.NarrowHeight != nil })},
+			{"height_offset", sizes.heightOffset, fromFlag("height-offset", heightSource)},
+			{"wide_main_width", sizes.wideMainWidth, fromFlag("wide-main-width", cfg.source(func(s settings) bool { return s.WideMainWidth != nil }))},
+			{"wide_main_percent", sizes.wideMainPercent, fromFlag("wide-main-percent", cfg.source(unset))},
+			{"panes", *panes, fromFlag("panes", cfg.source(func(s settings) bool { return s.Panes != nil }))},
+			{"main_pane", sizes.mainPane, fromFlag("main-pane", cfg.source(func(s settings) bool { return s.MainPane != nil }))},
+			{"max_windows", maxWindows, fromFlag("max-windows", cfg.source(func(s settings) bool { return s.MaxWindows != nil }))},
+			{"git_root", *useGitRoot || (cfg.GitRoot != nil && *cfg.GitRoot), gitRootSource},
+			{"default_session", defaultSession, cfg.source(func(s settings) bool { return s.DefaultSession != nil })},
+			{"editor", *editor, fromFlag("editor", editorSource)},
+			{"project_dirs", cfg.ProjectDirs, dirsSource},
+			{"ignore", ignore, ignoreSource},
+			{"query_timeout", queryTimeout.String(), cfg.source(func(s settings) bool { return s.QueryTimeout != nil || s.Timeout != nil })},
+			{"batch_timeout", batchTimeout.String(), cfg.source(func(s settings) bool { return s.BatchTimeout != nil || s.Timeout != nil })},
+		}
+		if err := showConfig(os.Stdout, values, cfg, *verbose); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to show config: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if os.Getenv("TMUX") == "" && *newSession == "" && !*sessionEach {
+		fmt.Fprintf(os.Stderr, "please run inside tmux\n")
+		os.Exit(1)
+	}
+
+	// With -switch, the client is switched to a workspace in another session than this one
+	currentSession := ""
+	if s, err := paneAttr("", "session_name"); err == nil {
+		currentSession = s[0]
+	}
+
+	// With -session-each, the session is named after each directory
+	if *session == "" && !*sessionEach {
+		s, err := paneAttr("", "session_name")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't find session name: %s\n", err.Error())
+			os.Exit(1)
+		}
+		session = &s[0]
+	}
+
+	// The shell is started by tmux with the command, so a shell without -l keeps the default
+	shell := ""
+	if *loginShell {
+		defaultShell := os.Getenv("SHELL")
+		if out, err := paneAttr("", "default-shell"); err == nil && out[0] != "" {
+			defaultShell = out[0]
+		}
+		cmd, err := loginShellCommand(defaultShell)
+		if err != nil {
+			warnf("%s, starting the default shell", err.Error())
+		}
+		shell = cmd
+	}
+
+	// The style flags replace the options of the template
+	windowOptions := map[string]string{}
+	for k, v := range tmpl.Options {
+		windowOptions[k] = v
+	}
+	if *statusStyle != "" {
+		windowOptions["window-status-style"] = *statusStyle
+	}
+	if *windowStyle != "" {
+		windowOptions["window-style"] = *windowStyle
+	}
+
+	// The layout of another window replaces the one of the template
+	layoutString := tmpl.Layout
+	if *layoutFrom != "" {
+		src, err := resolveWindow(*session, *layoutFrom, *first)
+		if err == nil {
+			var count int
+			layoutString, count, err = windowLayout(*session, src)
+			if err == nil && count != *panes {
+				err = fmt.Errorf("%s has %d panes, the new workspace has %d", src, count, *panes)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't copy the layout: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var sshHost, sshDir string
+	if *sshTarget != "" {
+		i := strings.Index(*sshTarget, ":")
+		if i < 1 || i == len(*sshTarget)-1 {
+			fmt.Fprintf(os.Stderr, "expected -ssh [user@]host:directory, got: %s\n", *sshTarget)
+			os.Exit(1)
+		}
+		sshHost, sshDir = (*sshTarget)[:i], (*sshTarget)[i+1:]
+	}
+
+	// Stale values, such as the SSH_AUTH_SOCK of an earlier login, are replaced in the session
+	var refreshEnv []string
+	for _, k := range refreshVars {
+		if v, ok := os.LookupEnv(k); ok {
+			refreshEnv = append(refreshEnv, k+"="+v)
+		} else {
+			warnf("%s is not set, not refreshing it", k)
+		}
+	}
+
+	// -no-env leaves out the variables of single panes too
+	if *noEnv {
+		paneEnvFlags = nil
+	}
+
+	// paneEnv gives the environment for the panes of a workspace in absPath. The history
+	// file of a remote workspace is set on the remote host instead.
+	paneEnv := func(absPath string, remote bool) ([]string, error) {
+		if *noEnv {
+			return nil, nil
+		}
+
+		var parentEnv []string
+		for _, k := range inheritEnv {
+			v, ok := os.LookupEnv(k)
+			if !ok {
+				warnf("%s is not set, skipping", k)
+				continue
+			}
+			parentEnv = append(parentEnv, k+"="+v)
+		}
+
+		histfile := ""
+		if !remote {
+			histDir := absPath
+			if *histfileRoot {
+				if root, ok := findRoot(absPath, ".git", rootMarker); ok {
+					histDir = root
+				}
+			}
+			histfile = filepath.Join(histDir, ".bash_history")
+		}
+
+		// Explicit -env values take precedence over inherited ones
+		env, err := workspaceEnv(histfile, cfg, tmpl, append(parentEnv, cliEnv...))
+		if err != nil {
+			return nil, fmt.Errorf("invalid environment: %w", err)
+		}
+
+		return env, nil
+	}
+
+	// openDir plans a new workspace for a directory, or for a clone of an existing window if dir is empty.
+	// A detached workspace is created without selecting its window.
+	openDir := func(dir string, detached bool, replace string) (*plan, error) {
+		window, derived := *window, false
+		layout := *layout
+		stickyDir := *stickyDir
+
+		var absPath string
+		if *clone {
+			// Create new workspace window like the given one
+			src := window
+			if src == "" {
+				w, err := paneAttr("", "window_name")
+				if err != nil {
+					return nil, fmt.Errorf("couldn't find window name: %w", err)
+				}
+				src = w[0]
+			}
+
+			absPath, err = workspaceDir(*session, src)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't find the directory of %s: %w", src, err)
+			}
+
+			window, err = uniqueWindowName(*session, src, *nameMaxLen)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't find a window name: %w", err)
+			}
+
+			if l := currentLayout(*session, src); layout == "" && lookupLayout(l) != nil {
+				layout = l
+			}
+
+			if d, err := windowOption(*session+":"+src, "@tmux_workspace_dir"); err == nil && d != "" {
+				stickyDir = true
+			}
+		} else if sshHost != "" {
+			// The remote directory is used as is
+			absPath = sshDir
+			if window == "" {
+				window = strings.ReplaceAll(path.Base(sshDir), ".", "_")
+				derived = true
+			}
+		} else {
+			// Create new workspace window for the given directory
+			absPath, err = filepath.Abs(dir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get absolute path of %s: %w", dir, err)
+			}
+
+			name := absPath
+			if *useGitRoot || (cfg.GitRoot != nil && *cfg.GitRoot) {
+				if root, ok := gitRoot(absPath); ok {
+					absPath = root
+					name = filepath.Base(root)
+				}
+			}
+
+			if *warnNested {
+				if id, parent, ok := enclosingWorkspace(*session, absPath); ok {
+					warnf("%s is inside the workspace for %s, select it with: tmux select-window -t %s", absPath, parent, id)
+				}
+			}
+
+			if window == "" && *scratch {
+				window = "scratch-" + time.Now().Format("20060102-150405")
+			} else if window == "" {
+				window = strings.ReplaceAll(name, ".", "_")
+				derived = true
+			}
+		}
+
+		// A truncated name may be shared by workspaces of different paths
+		if derived && len([]rune(window)) > *nameMaxLen && *nameMaxLen > 0 {
+			window, err = uniqueWindowName(*session, window, *nameMaxLen)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't find a window name: %w", err)
+			}
+		}
+
+		if *inPlace && !*force {
+			panes, err := paneAttr("", "pane_id")
+			if err != nil {
+				return nil, fmt.Errorf("couldn't count panes: %w", err)
+			}
+			if len(panes) > 1 {
+				return nil, fmt.Errorf("current window has %d panes, use -force to convert it anyway", len(panes))
+			}
+		}
+
+		env, err := paneEnv(absPath, sshHost != "")
+		if err != nil {
+			return nil, err
+		}
+
+		paneRoles := map[int]string{}
+		for _, r := range roles {
+			i := strings.Index(r, ":")
+			if i < 1 || i == len(r)-1 {
+				return nil, fmt.Errorf("expected -pane-role INDEX:NAME, got: %s", r)
+			}
+			index, err := strconv.Atoi(r[:i])
+			if err != nil {
+				return nil, fmt.Errorf("expected -pane-role INDEX:NAME, got: %s", r)
+			}
+			if index < 0 || index >= *panes {
+				return nil, fmt.Errorf("invalid pane %d for role %s, the workspace has %d panes", index, r[i+1:], *panes)
+			}
+			paneRoles[index] = r[i+1:]
+		}
+
+		paneEnvs := map[int][]string{}
+		for _, pe := range paneEnvFlags {
+			i := strings.Index(pe, ":")
+			if i < 1 || !strings.Contains(pe[i+1:], "=") || strings.HasPrefix(pe[i+1:], "=") {
+				return nil, fmt.Errorf("expected -pane-env INDEX:KEY=VALUE, got: %s", pe)
+			}
+			index, err := strconv.Atoi(pe[:i])
+			if err != nil {
+				return nil, fmt.Errorf("expected -pane-env INDEX:KEY=VALUE, got: %s", pe)
+			}
+			if index < 0 || index >= *panes {
+				return nil, fmt.Errorf("invalid pane %d for -pane-env %s, the workspace has %d panes", index, pe[i+1:], *panes)
+			}
+			if index == 0 && *inPlace {
+				return nil, fmt.Errorf("pane 0 is the current pane with -in-place, its environment can't be set")
+			}
+			paneEnvs[index] = append(paneEnvs[index], pe[i+1:])
+		}
+
+		paneOnce := map[int]string{}
+		for _, c := range onceCommands {
+			i := strings.Index(c, ":")
+			if i < 1 || i == len(c)-1 {
+				return nil, fmt.Errorf("expected -pane-cmd-once INDEX:COMMAND, got: %s", c)
+			}
+			index, err := strconv.Atoi(c[:i])
+			if err != nil {
+				return nil, fmt.Errorf("expected -pane-cmd-once INDEX:COMMAND, got: %s", c)
+			}
+			if index < 0 || index >= *panes {
+				return nil, fmt.Errorf("invalid pane %d for -pane-cmd-once %s, the workspace has %d panes", index, c[i+1:], *panes)
+			}
+			if index == 0 && *inPlace {
+				return nil, fmt.Errorf("pane 0 is the current pane with -in-place, it can't run a command instead of its shell")
+			}
+			if sshHost != "" {
+				return nil, fmt.Errorf("-pane-cmd-once can't be used with -ssh, as the command would run locally")
+			}
+			if index == *editorPane && *editor != "" {
+				return nil, fmt.Errorf("pane %d runs the editor, and can't run %s once", index, c[i+1:])
+			}
+			paneOnce[index] = c[i+1:]
+		}
+
+		// A missing script is skipped, so that the workspace is still created
+		paneScripts := map[int]string{}
+		for _, ps := range scriptFlags {
+			i := strings.Index(ps, ":")
+			if i < 1 || i == len(ps)-1 {
+				return nil, fmt.Errorf("expected -pane-script INDEX:PATH, got: %s", ps)
+			}
+			index, err := strconv.Atoi(ps[:i])
+			if err != nil {
+				return nil, fmt.Errorf("expected -pane-script INDEX:PATH, got: %s", ps)
+			}
+			if index < 0 || index >= *panes {
+				return nil, fmt.Errorf("invalid pane %d for -pane-script %s, the workspace has %d panes", index, ps[i+1:], *panes)
+			}
+			if sshHost != "" {
+				return nil, fmt.Errorf("-pane-script can't be used with -ssh, as the script is a local file")
+			}
+			if _, ok := paneOnce[index]; ok {
+				return nil, fmt.Errorf("pane %d runs a command once instead of a shell, and can't source %s", index, ps[i+1:])
+			}
+			if index == *editorPane && *editor != "" {
+				return nil, fmt.Errorf("pane %d runs the editor, and can't source %s", index, ps[i+1:])
+			}
+
+			script := ps[i+1:]
+			if !filepath.IsAbs(script) {
+				script = filepath.Join(absPath, script)
+			}
+			if _, err := os.Stat(script); err != nil {
+				warnf("skipping the script of pane %d: %s", index, err.Error())
+				continue
+			}
+			paneScripts[index] = script
+		}
+
+		if *zoom < -1 || *zoom >= *panes {
+			return nil, fmt.Errorf("invalid zoom pane %d, the workspace has %d panes", *zoom, *panes)
+		}
+
+		if *editorPane < 0 || *editorPane >= *panes {
+			return nil, fmt.Errorf("invalid editor pane %d, the workspace has %d panes", *editorPane, *panes)
+		}
+
+		maxWindows := *maxWindows
+		if maxWindows == 0 && cfg.MaxWindows != nil {
+			maxWindows = *cfg.MaxWindows
+		}
+
+		// The commands of a named layout take precedence over those of the template
+		paneCommands, paneDirs := map[int]string{}, map[int]string{}
+		for i, tp := range tmpl.Panes {
+			if tp.Command != "" {
+				paneCommands[i] = tp.Command
+			}
+			if tp.Dir != "" && filepath.IsAbs(tp.Dir) {
+				paneDirs[i] = tp.Dir
+			} else if tp.Dir != "" {
+				paneDirs[i] = filepath.Join(absPath, tp.Dir)
+			}
+		}
+
+		focusPane, focusLast := -1, false
+		var paneTitles map[int]string
+		if named != nil {
+			var namedCommands map[int]string
+			namedCommands, err = named.byIndex(layout, named.Commands)
+			for i, c := range namedCommands {
+				paneCommands[i] = c
+			}
+			if err == nil {
+				paneTitles, err = named.byIndex(layout, named.Titles)
+			}
+			if err == nil && named.FocusAfterRun != "" {
+				focusPane, err = named.paneIndex(layout, named.FocusAfterRun)
+				focusLast = true
+				if _, ok := paneCommands[focusPane]; err == nil && !ok {
+					err = fmt.Errorf("pane %s has no command to focus after", named.FocusAfterRun)
+				}
+			} else if err == nil && named.Focus != "" {
+				focusPane, err = named.paneIndex(layout, named.Focus)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid layout: %w", err)
+			}
+			layout = named.Layout
+		}
+		for i := range paneOnce {
+			if _, ok := paneCommands[i]; ok {
+				return nil, fmt.Errorf("pane %d already has a command from the config, and can't run another once", i)
+			}
+		}
+
+		p, err := openWindow(*session, window, absPath, openOptions{
+			env:         env,
+			paneEnv:     paneEnvs,
+			refresh:     refreshEnv,
+			layout:      layout,
+			inPlace:     *inPlace,
+			stickyDir:   stickyDir,
+			panes:       *panes,
+			shell:       shell,
+			detached:    detached,
+			position:    *position,
+			deferResize: *deferResize,
+			sizes:       sizes,
+			maxWindows:  maxWindows,
+			minWidth:    minWidth,
+			minHeight:   minHeight,
+			editor:      *editor,
+			editorPane:  *editorPane,
+
+			paneCommands: paneCommands,
+			paneOnce:     paneOnce,
+			paneScripts:  paneScripts,
+			cmdPrefix:    *commandPrefix,
+			paneDirs:     paneDirs,
+			layoutString: layoutString,
+			paneTitles:   paneTitles,
+			paneRoles:    paneRoles,
+			focusPane:    focusPane,
+			focusLast:    focusLast,
+			zoomPane:     *zoom,
+
+			newSession:   *newSession != "",
+			client:       *client,
+			switchClient: !detached && *newSession == "" && (*switchFlag && *session != currentSession || useDefault),
+			planned:      sessionPlanned,
+			replace:      replace,
+			sessionGroup: *sessionGroup,
+			scratch:      *scratch,
+			ssh:          sshHost,
+
+			onCreate:        *onCreate,
+			monitorActivity: *monitorActivity,
+			monitorBell:     *monitorBell,
+			remainOnExit:    *remainOnExit,
+			sync:            *sync,
+
+			windowOptions: windowOptions,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("open failed: %w", err)
+		}
+
+		return p, nil
+	}
+
+	// The plans of all actions are written at the end with -plan-out
+	var plans []*plan
+	dryRun := *prnt || *describe || *planOut != ""
+
+	execOpts := executeOptions{
+		prnt:        *prnt,
+		describe:    *describe,
+		logJSON:     *logJSON,
+		waitReady:   *waitReadyFlag,
+		waitTimeout: *waitTimeout,
+
+		inspectOnError: *inspectOnError,
+		controlMode:    *controlMode,
+		sourceFile:     *sourceFile,
+
+		sizes: sizes,
+	}
+
+	// flipOpen selects and flips the workspace window for dir, resolved like openDir does,
+	// if one is open, or only selects it if it can't be flipped. It returns false if there
+	// is none, to create it instead.
+	flipOpen := func(dir string) (bool, error) {
+		absPath, err := filepath.Abs(dir)
+		if err != nil {
+			return false, fmt.Errorf("failed to get absolute path of %s: %w", dir, err)
+		}
+		if *useGitRoot || (cfg.GitRoot != nil && *cfg.GitRoot) {
+			if root, ok := gitRoot(absPath); ok {
+				absPath = root
+			}
+		}
+
+		id, ok := openWorkspace(*session, absPath)
+		if !ok {
+			verbosef("no workspace for %s, creating it", absPath)
+			return false, nil
+		}
+
+		focus := &plan{
+			Action:   "focus",
+			Session:  *session,
+			Window:   id,
+			Commands: []string{"select-window", "-t", id, ";"},
+		}
+		if *switchFlag && *session != currentSession {
+			focus.Commands = []string{"switch-client", "-t", id, ";"}
+		}
+		flip, err := flipLayout(*session, id, flipOptions{
+			mode:  *flipMode,
+			to:    *flipTo,
+			force: *force,
+			sizes: sizes,
+
+			swapOnly: *swapOnly,
+			noSelect: *noSelect,
+		})
+		plans := []*plan{focus, flip}
+		if err != nil {
+			// A window without the panes of a layout, such as one with a single pane, is only selected
+			verbosef("not flipping %s: %s", id, err.Error())
+			plans = plans[:1]
+		}
+
+		for _, p := range plans {
+			if err := execute(p, execOpts); err != nil {
+				return false, err
+			}
+		}
+
+		return true, nil
+	}
+
+	if *planOut != "" {
+		execOpts.plans = &plans
+	}
+
+	dirs := flag.Args()
+	if *readStdin {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if d := strings.TrimSpace(scanner.Text()); d != "" {
+				dirs = append(dirs, d)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read stdin: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *glob != "" {
+		matches, err := globDirs(*glob, cfg.ignorePatterns())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		if len(matches) == 0 {
+			fmt.Fprintf(os.Stderr, "no directories match %s\n", *glob)
+			os.Exit(1)
+		}
+		dirs = append(dirs, matches...)
+	}
+
+	if *scratch {
+		if *readStdin || *clone {
+			fmt.Fprintf(os.Stderr, "-scratch can't be combined with -stdin or -clone\n")
+			os.Exit(1)
+		}
+
+		// The directory is created when the workspace is, and a dry run shows its pattern
+		dirs = []string{filepath.Join(os.TempDir(), scratchPattern)}
+	}
+
+	// Without a terminal to prompt on, -interactive falls back to flipping the layout
+	if *interactive && len(dirs) == 0 && !*clone && sshHost == "" && isTerminal(os.Stdin) {
+		candidates, err := recentDirs(statePath())
+		if err != nil {
+			warnf("%s", err.Error())
+		}
+		var roots []string
+		for _, d := range cfg.ProjectDirs {
+			roots = append(roots, os.ExpandEnv(d))
+		}
+		if projects, err := pickCandidates(roots, cfg.ignorePatterns()); err != nil {
+			warnf("%s", err.Error())
+		} else {
+			seen := map[string]bool{}
+			for _, c := range candidates {
+				seen[c] = true
+			}
+			for _, c := range projects {
+				if !seen[c] {
+					candidates = append(candidates, c)
+				}
+			}
+		}
+
+		if len(candidates) == 0 {
+			fmt.Fprintf(os.Stderr, "no recent workspaces or project_dirs to pick from\n")
+			os.Exit(1)
+		}
+		dir, err := pickInteractively(os.Stdin, os.Stderr, candidates)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read the choice: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if dir == "" {
+			return
+		}
+		dirs = []string{dir}
+	}
+
+	if *nameMaxLen < 0 || *nameMaxLen != 0 && *nameMaxLen < minNameLen {
+		fmt.Fprintf(os.Stderr, "invalid -name-max-len %d, expected at least %d\n", *nameMaxLen, minNameLen)
+		os.Exit(1)
+	}
+
+	if *position != "end" && *position != "after" && *position != "before" {
+		fmt.Fprintf(os.Stderr, "invalid -position %s, expected after, before or end\n", *position)
+		os.Exit(1)
+	}
+
+	if *client != "" {
+		out, err := queryTmux("list-clients", "-F", "#{client_name}"+recordSeparator)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't list clients: %s\n", err.Error())
+			os.Exit(1)
+		}
+		clients := splitRecords(out)
+		found := false
+		for _, c := range clients {
+			found = found || c == *client
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "no client %s, the clients are: %s\n", *client, strings.Join(clients, ", "))
+			os.Exit(1)
+		}
+	}
+
+	if *focus != "first" && *focus != "last" && *focus != "none" {
+		fmt.Fprintf(os.Stderr, "invalid -focus %s, expected first, last or none\n", *focus)
+		os.Exit(1)
+	}
+
+	if len(dirs) > 1 && (*window != "" || *inPlace || *newSession != "" && !createDefault) {
+		fmt.Fprintf(os.Stderr, "-window, -in-place and -new-session can't be used with multiple directories\n")
+		os.Exit(1)
+	}
+	if *sessionEach && (*window != "" || *inPlace || *newSession != "" || *clone || sshHost != "" || *openOrFlip) {
+		fmt.Fprintf(os.Stderr, "-session-each can't be combined with -window, -in-place, -new-session, -clone, -ssh or -open-or-flip\n")
+		os.Exit(1)
+	}
+
+	if *bindKey != "" {
+		p, err := installKeybinding(*bindKey, *noSelect)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to install key binding: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if err := execute(p, execOpts); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+	} else if len(dirs) > 0 || *clone || sshHost != "" {
+		if *clone || sshHost != "" {
+			dirs = []string{""}
+		}
+
+		// A clone goes next to its source, and -in-place uses the current window
+		if balance && !*clone && !*inPlace {
+			if name, err := emptiestSession(); err != nil {
+				warnf("%s, using the current session", err.Error())
+			} else {
+				verbosef("picked session %s", name)
+				session = &name
+			}
+		}
+
+		// Each workspace is created before planning the next, so their window names are checked.
+		// The windows of a batch are created without selecting them, to select one at the end.
+		batch := len(dirs) > 1
+		var created, sessions []string
+		for _, dir := range dirs {
+			if *sessionEach {
+				name, err := sessionName(dir, *useGitRoot || (cfg.GitRoot != nil && *cfg.GitRoot))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+					os.Exit(1)
+				}
+				session, newSession = &name, &name
+			}
+
+			if *openOrFlip {
+				if ok, err := flipOpen(dir); err != nil {
+					fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+					os.Exit(1)
+				} else if ok {
+					continue
+				}
+			}
+
+			// A scratch directory is removed again if its workspace can't be opened
+			newScratch := *scratch && !dryRun
+			if newScratch {
+				if dir, err = os.MkdirTemp("", scratchPattern); err != nil {
+					fmt.Fprintf(os.Stderr, "failed to create scratch directory: %s\n", err.Error())
+					os.Exit(1)
+				}
+			}
+
+			p, err := openRetrying(func() (*plan, error) { return openDir(dir, batch, "") }, execOpts)
+			if err != nil {
+				if newScratch {
+					os.RemoveAll(dir)
+				}
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			if newScratch && verbosity >= 0 {
+				fmt.Fprintf(os.Stderr, "scratch directory: %s\n", dir)
+			}
+			created = append(created, p.Window)
+			sessions = append(sessions, p.Session)
+			if createDefault {
+				none := ""
+				newSession, sessionPlanned = &none, dryRun
+			}
+
+			// Remote and scratch directories aren't worth picking again
+			if !dryRun && sshHost == "" && !*scratch {
+				if err := recordRecent(statePath(), p.Directory); err != nil {
+					warnf("couldn't record the workspace: %s", err.Error())
+				}
+			}
+		}
+
+		if *glob != "" && !dryRun && verbosity >= 0 {
+			fmt.Fprintf(os.Stderr, "created %d workspaces\n", len(created))
+		}
+		if *sessionEach && !dryRun && verbosity >= 0 {
+			fmt.Fprintf(os.Stderr, "created sessions: %s\n", strings.Join(sessions, ", "))
+		}
+
+		// The new sessions of -session-each and the default session are switched to, or
+		// attached outside tmux
+		if batch && *focus != "none" {
+			i := 0
+			if *focus == "last" {
+				i = len(created) - 1
+			}
+			s, w := sessions[i], created[i]
+			p := &plan{
+				Action:   "focus",
+				Session:  s,
+				Window:   w,
+				Commands: []string{"select-window", "-t", s + ":" + w, ";"},
+			}
+			if (*sessionEach || useDefault) && os.Getenv("TMUX") == "" {
+				p.Attach = s
+			} else if *sessionEach || useDefault || (*switchFlag && s != currentSession) {
+				p.Commands = []string{"switch-client", "-t", s + ":" + w, ";"}
+			}
+			if err := execute(p, execOpts); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+	} else if *killAll {
+		if *window != "" || *all || *kill || *pin || *unpin {
+			fmt.Fprintf(os.Stderr, "-kill-all can't be combined with -window, -all, -kill, -pin or -unpin\n")
+			os.Exit(1)
+		}
+
+		// The current window goes last, and the counts are reported first, as killing it
+		// may end this process
+		current := ""
+		if id, err := paneAttr("", "window_id"); err == nil {
+			current = id[0]
+		}
+		ids, _ := workspaceWindows(*session)
+		for i, id := range ids {
+			if id == current {
+				ids = append(append(ids[:i:i], ids[i+1:]...), id)
+				break
+			}
+		}
+
+		var kills []*plan
+		pinned := 0
+		for _, id := range ids {
+			if v, _ := windowOption(id, pinnedOption); v == "1" && !*forcePinned {
+				verbosef("skipping %s: pinned", id)
+				pinned++
+				continue
+			}
+
+			p, err := killWindow(*session, id)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to kill window: %s\n", err.Error())
+				os.Exit(1)
+			}
+			kills = append(kills, p)
+		}
+
+		if !dryRun && verbosity >= 0 {
+			fmt.Fprintf(os.Stderr, "killing %d workspace windows, %d skipped as pinned\n", len(kills), pinned)
+		}
+		for _, p := range kills {
+			if err := execute(p, execOpts); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+	} else if *all {
+		if *window != "" || *addPaneFlag || *removePaneIndex >= 0 || *kill || *pin || *unpin || *reopen || *refresh || *showLayout || *showDir || *exportName != "" || *diffName != "" {
+			fmt.Fprintf(os.Stderr, "-all can only be used to flip or apply a layout\n")
+			os.Exit(1)
+		}
+
+		ids, err := windowAttr(*session, "window_id")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't list windows: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		applyName := *applyLayoutName
+		if def, ok, err := cfg.layout(applyName); err == nil && ok && def.Layout != "" {
+			applyName = def.Layout
+		}
+
+		// Flipping is for workspace windows, while a layout can be applied to any window with enough panes
+		updated, unchanged, skipped := 0, 0, 0
+		for _, id := range ids {
+			var p *plan
+			if applyName != "" {
+				p, err = applyNamedLayout(*session, id, applyName, sizes)
+			} else if !isWorkspace(id) {
+				verbosef("skipping %s: not a workspace window", id)
+				skipped++
+				continue
+			} else {
+				p, err = flipLayout(*session, id, flipOptions{
+					mode:  *flipMode,
+					to:    *flipTo,
+					force: *force,
+					sizes: sizes,
+
+					swapOnly: *swapOnly,
+					noSelect: *noSelect,
+				})
+			}
+			if err != nil {
+				verbosef("skipping %s: %s", id, err.Error())
+				skipped++
+				continue
+			}
+
+			if err := execute(p, execOpts); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			if len(p.Commands) == 0 {
+				unchanged++
+			} else {
+				updated++
+			}
+		}
+
+		if verbosity >= 0 {
+			fmt.Fprintf(os.Stderr, "%d windows updated, %d already had the layout, %d skipped\n", updated, unchanged, skipped)
+		}
+	} else {
+		if *window != "" {
+			w, err := resolveWindow(*session, *window, *first)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			window = &w
+		} else {
+			w, err := paneAttr("", "window_name")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "couldn't find window name: %s\n", err.Error())
+				os.Exit(1)
+			}
+			window = &w[0]
+		}
+
+		if *showLayout {
+			fmt.Println(currentLayout(*session, *window))
+			return
+		}
+
+		if *showDir {
+			dir, err := workspaceDir(*session, *window)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "couldn't find the directory of window %s: %s\n", *window, err.Error())
+				os.Exit(1)
+			}
+			fmt.Println(dir)
+			return
+		}
+
+		if *diffName != "" {
+			want, err := cfg.template(*diffName)
+			if err == nil && len(want.Panes) == 0 && want.Layout == "" {
+				err = fmt.Errorf("template %s has no panes or layout to compare", *diffName)
+			}
+			var live *template
+			if err == nil {
+				live, err = captureTemplate(*session, *window)
+			}
+			// The directories of the window are captured relative to its first pane
+			var paths []string
+			if err == nil {
+				paths, err = paneAttr(*session+":"+*window, "pane_current_path")
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to compare with template: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			diffs := diffTemplate(live, want, paths[0])
+			for _, d := range diffs {
+				fmt.Println(d)
+			}
+			if len(diffs) > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+
+		if *exportName != "" {
+			t, err := captureTemplate(*session, *window)
+			if err == nil && *prnt {
+				enc := yaml.NewEncoder(os.Stdout)
+				enc.SetIndent(2)
+				err = enc.Encode(map[string]*template{*exportName: t})
+			} else if err == nil {
+				err = exportTemplate(*configPath, *exportName, t, *force)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to export template: %s\n", err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+
+		if named != nil {
+			layout = &named.Layout
+		}
+
+		var p *plan
+		if *addPaneFlag {
+			dir, err := workspaceDir(*session, *window)
+			if err == nil {
+				var env []string
+				if env, err = paneEnv(dir, false); err == nil {
+					p, err = addPane(*session, *window, dir, env, shell, sizes)
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to add pane: %s\n", err.Error())
+				os.Exit(1)
+			}
+		} else if *removePaneIndex >= 0 {
+			p, err = removePane(*session, *window, *removePaneIndex, *force, sizes)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to remove pane: %s\n", err.Error())
+				os.Exit(1)
+			}
+		} else if *reopen {
+			// The new window is planned with the name, and kills the old one by id before it's created
+			absWin := *session + ":" + *window
+			var dir string
+			var busy, ids []string
+			if busy, err = busyPanes(absWin); err == nil && len(busy) > 0 && !*force {
+				err = fmt.Errorf("%s, use -force to reopen it anyway", strings.Join(busy, ", "))
+			}
+			if err == nil {
+				dir, err = workspaceDir(*session, *window)
+			}
+			if err == nil {
+				ids, err = paneAttr(absWin, "window_id")
+			}
+			if err == nil {
+				var names []string
+				if names, err = paneAttr(absWin, "window_name"); err == nil {
+					window = &names[0]
+					p, err = openDir(dir, false, ids[0])
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to reopen window: %s\n", err.Error())
+				os.Exit(1)
+			}
+		} else if *pin || *unpin {
+			if *pin && *unpin {
+				fmt.Fprintf(os.Stderr, "-pin and -unpin can't be combined\n")
+				os.Exit(1)
+			}
+			if !isWorkspace(*session + ":" + *window) {
+				fmt.Fprintf(os.Stderr, "window %s is not a workspace\n", *window)
+				os.Exit(1)
+			}
+			p = pinWindow(*session, *window, *pin)
+		} else if *kill {
+			p, err = killWindow(*session, *window)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to kill window: %s\n", err.Error())
+				os.Exit(1)
+			}
+		} else if *applyLayoutName != "" {
+			name := *applyLayoutName
+			if def, ok, err := cfg.layout(name); err == nil && ok && def.Layout != "" {
+				name = def.Layout
+			}
+			p, err = applyNamedLayout(*session, *window, name, sizes)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to apply layout: %s\n", err.Error())
+				os.Exit(1)
+			}
+		} else if *refresh {
+			// Reapply the layout for the given workspace window
+			p, err = refreshLayout(*session, *window, *layout, *force, sizes)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to refresh layout: %s\n", err.Error())
+				os.Exit(1)
+			}
+		} else {
+			// Flip layout for the given workspace window
+			p, err = flipLayout(*session, *window, flipOptions{
+				mode:  *flipMode,
+				to:    *flipTo,
+				force: *force,
+				sizes: sizes,
+
+				swapOnly: *swapOnly,
+				noSelect: *noSelect,
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to flip layouts: %s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+
+		if err := execute(p, execOpts); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+
+		if p.Action == "remove-pane" && !dryRun && verbosity >= 0 {
+			if p.Panes == 0 {
+				fmt.Fprintf(os.Stderr, "%s:%s is closed\n", p.Session, p.Window)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s:%s has %d panes\n", p.Session, p.Window, p.Panes)
+			}
+		}
+	}
+
+	if *planOut != "" {
+		if err := writePlans(*planOut, plans); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 			os.Exit(1)
 		}
 	}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestFlipLayoutKeepsFocus(t *testing.T) {
+	for _, mode := range []string{"swap", "rotate"} {
+		for active := 0; active < workspacePanes; active++ {
+			t.Run(fmt.Sprintf("%s/%d", mode, active), func(t *testing.T) {
+				activity := []string{"0", "0", "0"}
+				activity[active] = "1"
+				useFake(t, &fakeTmux{replies: map[string]string{
+					paneQuery("s:w", "pane_at_bottom"):  records("1", "0", "1"),
+					paneQuery("s:w", "pane_active"):     records(activity...),
+					optionQuery("s:w", paneCountOption): "",
+				}})
+
+				p, err := flipLayout("s", "w", flipOptions{mode: mode, sizes: defaultLayoutOptions})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				cmds := splitCommands(p.Commands)
+				want := []string{"select-pane", "-t", fmt.Sprintf("s:w.%d", active)}
+				if got := cmds[len(cmds)-1]; !reflect.DeepEqual(got, want) {
+					t.Errorf("last command is %v, want %v", got, want)
+				}
+				if p.Layout != "wide" {
+					t.Errorf("flipped to %s, want wide", p.Layout)
+				}
+			})
+		}
+	}
+}
+
+func TestTruncateName(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		maxLen int
+		want   string
+	}{
+		{"/tmp/proj/longname", 0, "/tmp/proj/longname"},
+		{"/tmp/proj/longname", 18, "/tmp/proj/longname"},
+		{"/tmp/proj/longname", 11, "___longname"},
+		{"/tmp/proj/longname", 4, "___e"},
+		{"/tmp/proj/longname", 3, "___e"},
+		{"/tmp/proj/longname", 1, "___e"},
+	} {
+		if got := truncateName(tc.name, tc.maxLen); got != tc.want {
+			t.Errorf("truncateName(%q, %d) = %q, want %q", tc.name, tc.maxLen, got, tc.want)
+		}
+	}
+}
+
+func TestUniqueWindowNameShortMaxLen(t *testing.T) {
+	for _, tc := range []struct {
+		maxLen int
+		taken  []string
+		want   string
+	}{
+		{4, []string{"___e"}, "___e-2"},
+		{4, []string{"___e", "___e-2"}, "___e-3"},
+		{minNameLen, []string{"___ame"}, "___e-2"},
+		{0, []string{"/tmp/proj/longname"}, "/tmp/proj/longname-2"},
+	} {
+		useFake(t, &fakeTmux{replies: map[string]string{
+			windowQuery("s", "window_name"): records(tc.taken...),
+		}})
+
+		got, err := uniqueWindowName("s", "/tmp/proj/longname", tc.maxLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("uniqueWindowName with %d and %v = %q, want %q", tc.maxLen, tc.taken, got, tc.want)
+		}
+	}
+}
+
+func TestPaneCountError(t *testing.T) {
+	useFake(t, &fakeTmux{replies: map[string]string{
+		paneQuery("s:w", "pane_index"): records("0", "2"),
+	}})
+	want := "expected 3 panes in s:w, got: 2 (0,2)"
+	if err := paneCountError("s:w", 3, 2); err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+
+	// The indices are left out when they can't be listed
+	useFake(t, &fakeTmux{replies: map[string]string{}})
+	want = "expected 3 panes in s:gone, got: 0"
+	if err := paneCountError("s:gone", 3, 0); err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
+
+func TestOpenRetryingAfterRace(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		races    int
+		attempts int
+		err      error
+	}{
+		{"no race", 0, 1, nil},
+		{"one race", 1, 2, nil},
+		{"races until the last attempt", maxAttempts - 1, maxAttempts, nil},
+		{"races every attempt", maxAttempts, maxAttempts, errWindowRace},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			races := tc.races
+			fake := &fakeTmux{
+				replies: map[string]string{
+					windowQuery("s", "window_name"): records("bash", "w", "w"),
+					paneQuery("s:w", "pane_id"):     records("%1"),
+				},
+				// The other window with the name makes the commands targeting it fail
+				batch: func(args []string) (string, error) {
+					if args[0] == "new-window" && races > 0 {
+						races--
+						return "@7\ncan't find window: w\n", errors.New("exit status 1")
+					}
+					return "", nil
+				},
+			}
+			useFake(t, fake)
+
+			attempts := 0
+			_, err := openRetrying(func() (*plan, error) {
+				attempts++
+				return &plan{
+					Action:   "open",
+					Session:  "s",
+					Window:   "w",
+					Panes:    1,
+					Commands: []string{"new-window", "-P", "-F", "#{window_id}", "-t", "s:", "-n", "w", ";", "set-option", "-w", "-t", "s:w", "@x", "1", ";"},
+				}, nil
+			}, executeOptions{})
+
+			if attempts != tc.attempts {
+				t.Errorf("planned %d times, want %d", attempts, tc.attempts)
+			}
+			if !errors.Is(err, tc.err) || (tc.err == nil && err != nil) {
+				t.Errorf("got error %v, want %v", err, tc.err)
+			}
+
+			// The new window of each race is killed
+			kills := 0
+			for _, b := range fake.batches {
+				if b[0] == "kill-window" {
+					kills++
+					if want := []string{"kill-window", "-t", "@7", ";"}; !reflect.DeepEqual(b, want) {
+						t.Errorf("killed with %v, want %v", b, want)
+					}
+				}
+			}
+			if kills != tc.races {
+				t.Errorf("killed %d windows, want %d", kills, tc.races)
+			}
+		})
+	}
+}
+
+func TestOpenWindowReadyPanes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		inPlace bool
+		once    map[int]string
+		want    []string
+	}{
+		{"new window", false, nil, []string{"s:w.0", "s:w.1", "s:w.2"}},
+		{"pane cmd once", false, map[int]string{1: "make test"}, []string{"s:w.0", "s:w.2"}},
+		{"in place", true, nil, []string{"@7.1", "@7.2"}},
+		{"in place and once", true, map[int]string{2: "make test"}, []string{"@7.1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useFake(t, &fakeTmux{replies: map[string]string{
+				windowQuery("s", "window_name"):                    records("other"),
+				"list-panes -F #{window_width}" + recordSeparator:  records("200"),
+				"list-panes -F #{window_height}" + recordSeparator: records("50"),
+				"list-panes -F #{window_id}" + recordSeparator:     records("@7"),
+			}})
+
+			p, err := openWindow("s", "w", t.TempDir(), openOptions{
+				panes:     workspacePanes,
+				inPlace:   tc.inPlace,
+				paneOnce:  tc.once,
+				sizes:     defaultLayoutOptions,
+				focusPane: -1,
+				zoomPane:  -1,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(p.Ready, tc.want) {
+				t.Errorf("ready panes are %v, want %v", p.Ready, tc.want)
+			}
+		})
+	}
+}
+
+func TestPaneCountChangeKeepsLayoutsInStep(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		layout string
+		panes  int
+		add    bool
+		want   string
+	}{
+		{"remove from narrow", "narrow", 3, false, "rows"},
+		{"remove from wide", "wide", 3, false, "columns"},
+		{"remove from four panes", "wide", 4, false, "wide"},
+		{"add to rows", "rows", 2, true, "narrow"},
+		{"add to columns", "columns", 2, true, "wide"},
+		{"add to narrow", "narrow", 3, true, "narrow"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ids := make([]string, tc.panes)
+			for i := range ids {
+				ids[i] = strconv.Itoa(i)
+			}
+			useFake(t, &fakeTmux{replies: map[string]string{
+				paneQuery("s:w", "pane_index"):   records(ids...),
+				paneQuery("s:w", "pane_id"):      records(ids...),
+				optionQuery("s:w", layoutOption): tc.layout,
+			}})
+
+			var p *plan
+			var err error
+			if tc.add {
+				p, err = addPane("s", "w", "/tmp", nil, "", defaultLayoutOptions)
+			} else {
+				p, err = removePane("s", "w", 0, false, defaultLayoutOptions)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Layout != tc.want {
+				t.Errorf("reapplied %s, want %s", p.Layout, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddPaneToSinglePane(t *testing.T) {
+	for _, tc := range []struct {
+		width string
+		want  string
+	}{
+		{"200", "rows"},
+		{"400", "columns"},
+	} {
+		useFake(t, &fakeTmux{replies: map[string]string{
+			paneQuery("s:w", "pane_id"):        records("%1"),
+			paneQuery("s:w", "pane_at_bottom"): records("1"),
+			paneQuery("s:w", "window_width"):   records(tc.width),
+			paneQuery("s:w", "window_height"):  records("50"),
+			optionQuery("s:w", layoutOption):   "",
+		}})
+
+		p, err := addPane("s", "w", "/tmp", nil, "", defaultLayoutOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Layout != tc.want || p.Panes != 2 {
+			t.Errorf("added a pane to a %s wide window with the %s layout and %d panes, want %s and 2", tc.width, p.Layout, p.Panes, tc.want)
+		}
+		if cmds := splitCommands(p.Commands); cmds[0][0] != "split-window" {
+			t.Errorf("first command is %v, want split-window", cmds[0])
+		}
+	}
+}
+
+func TestDeferResizeTargetsCurrentWindow(t *testing.T) {
+	cmds := splitCommands(deferResize("s", "s:w", applyLayout("s:w", "narrow", defaultLayoutOptions)))
+
+	var deferred string
+	for _, cmd := range cmds {
+		if cmd[0] == "resize-pane" {
+			t.Errorf("resize-pane isn't deferred: %v", cmd)
+		}
+		if cmd[0] == "set-option" && cmd[len(cmd)-2] == deferredOption {
+			deferred = cmd[len(cmd)-1]
+		}
+	}
+
+	want := "resize-pane -x 90 -y 20 -t .1 ; " +
+		"set-option -w -F @tmux_workspace_layout_string '#{window_layout}' ; " +
+		"set-option -wu @tmux_workspace_deferred"
+	if deferred != want {
+		t.Errorf("deferred commands are %q, want %q", deferred, want)
+	}
+}
+
+func TestKillWindowRemovesOnlyScratchDirs(t *testing.T) {
+	tmp := filepath.Clean(os.TempDir())
+	for _, tc := range []struct {
+		dir    string
+		remove string
+	}{
+		{"", ""},
+		{filepath.Join(tmp, "tmux-workspace-scratch-123"), filepath.Join(tmp, "tmux-workspace-scratch-123")},
+		{filepath.Join(tmp, "other"), ""},
+		{filepath.Join(tmp, "tmux-workspace-scratch-123", "sub"), ""},
+		{"/home/me/tmux-workspace-scratch-123", ""},
+	} {
+		useFake(t, &fakeTmux{replies: map[string]string{
+			optionQuery("s:w", scratchOption): tc.dir,
+		}})
+
+		p, err := killWindow("s", "w")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Remove != tc.remove {
+			t.Errorf("killing a window with the scratch directory %q removes %q, want %q", tc.dir, p.Remove, tc.remove)
+		}
+	}
+}
+
+func TestFlipCommandQuotesExecutable(t *testing.T) {
+	for _, tc := range []struct {
+		exe      string
+		noSelect bool
+		want     string
+	}{
+		{"/usr/bin/tmux-workspace", false, "'/usr/bin/tmux-workspace' -session '#{session_name}' -window '#{window_id}'"},
+		{"/home/me/it's/tmux-workspace", true, `'/home/me/it'\''s/tmux-workspace' -session '#{session_name}' -window '#{window_id}' -no-select`},
+	} {
+		if got := flipCommand(tc.exe, tc.noSelect); got != tc.want {
+			t.Errorf("flipCommand(%q, %t) = %s, want %s", tc.exe, tc.noSelect, got, tc.want)
+		}
+	}
+}
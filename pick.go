@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultIgnore are the patterns of the directories skipped by -pick unless configured otherwise
+var defaultIgnore = []string{".*"}
+
+// pickCandidates lists the subdirectories of the roots, skipping those with a basename
+// that matches one of the ignore patterns
+func pickCandidates(roots, ignore []string) ([]string, error) {
+	var result []string
+	for _, root := range roots {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", root, err)
+		}
+
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+
+			ignored, err := matchAny(ignore, e.Name())
+			if err != nil {
+				return nil, err
+			}
+			if !ignored {
+				result = append(result, filepath.Join(root, e.Name()))
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// matchAny tells if name matches one of the patterns
+func matchAny(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		ok, err := filepath.Match(pattern, name)
+		if err != nil {
+			return false, fmt.Errorf("invalid ignore pattern %s: %w", pattern, err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// globDirs returns the directories matching pattern, after expanding a leading ~ to the
+// home directory, and skipping those with a basename that matches one of the ignore patterns
+func globDirs(pattern string, ignore []string) ([]string, error) {
+	if pattern == "~" || strings.HasPrefix(pattern, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand ~: %w", err)
+		}
+		pattern = home + pattern[1:]
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %s: %w", pattern, err)
+	}
+
+	var result []string
+	for _, m := range matches {
+		if info, err := os.Stat(m); err != nil || !info.IsDir() {
+			continue
+		}
+
+		ignored, err := matchAny(ignore, filepath.Base(m))
+		if err != nil {
+			return nil, err
+		}
+		if !ignored {
+			result = append(result, m)
+		}
+	}
+
+	return result, nil
+}
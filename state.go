@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxRecent is the number of directories kept in the state file
+const maxRecent = 50
+
+// statePath returns the location of the file with the recent workspace directories, or
+// "" if no cache dir can be determined
+func statePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "tmux-workspace", "recent")
+}
+
+// recentDirs reads the recent workspace directories from the state file, most recent
+// first. A missing file gives no directories.
+func recentDirs(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state: %w", err)
+	}
+
+	var dirs []string
+	for _, d := range strings.Split(string(b), "\n") {
+		if d != "" {
+			dirs = append(dirs, d)
+		}
+	}
+
+	return dirs, nil
+}
+
+// recordRecent moves dir to the front of the recent directories in the state file
+func recordRecent(path, dir string) error {
+	if path == "" {
+		return nil
+	}
+
+	dirs, err := recentDirs(path)
+	if err != nil {
+		return err
+	}
+
+	result := []string{dir}
+	for _, d := range dirs {
+		if d != dir && len(result) < maxRecent {
+			result = append(result, d)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create state dir: %w", err)
+	}
+
+	return os.WriteFile(path, []byte(strings.Join(result, "\n")+"\n"), 0o644)
+}
+
+// isTerminal tells if f is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// pickInteractively shows the candidates as a numbered menu on w and reads the choice
+// from r; a number, or a word that narrows the menu down to the candidates containing
+// it. It returns "" if nothing is picked.
+func pickInteractively(r io.Reader, w io.Writer, candidates []string) (string, error) {
+	in := bufio.NewScanner(r)
+	shown := candidates
+	for {
+		for i, c := range shown {
+			fmt.Fprintf(w, "%3d  %s\n", i+1, c)
+		}
+		fmt.Fprint(w, "workspace> ")
+
+		if !in.Scan() {
+			fmt.Fprintln(w)
+			return "", in.Err()
+		}
+		answer := strings.TrimSpace(in.Text())
+		if answer == "" {
+			return "", nil
+		}
+
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(shown) {
+			return shown[n-1], nil
+		}
+
+		var matches []string
+		for _, c := range candidates {
+			if strings.Contains(c, answer) {
+				matches = append(matches, c)
+			}
+		}
+		if len(matches) == 1 {
+			return matches[0], nil
+		}
+		if len(matches) == 0 {
+			fmt.Fprintf(w, "no workspace matches %s\n", answer)
+		} else {
+			shown = matches
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// queryTimeout and batchTimeout limit how long a query of tmux state and a batch of
+// commands may take, 0 for no limit
+var queryTimeout, batchTimeout time.Duration
+
+// tmuxCommand prepares tmux with args, to be killed after timeout unless it is 0. The
+// cancel function releases the timer once the command is done.
+func tmuxCommand(timeout time.Duration, args []string) (*exec.Cmd, context.CancelFunc) {
+	if timeout == 0 {
+		return exec.Command("tmux", args...), func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return exec.CommandContext(ctx, "tmux", args...), cancel
+}
+
+// timedOut replaces the error of a killed tmux command with one telling why
+func timedOut(cmd *exec.Cmd, timeout time.Duration, err error) error {
+	killed := cmd.ProcessState != nil && !cmd.ProcessState.Exited()
+	if err != nil && timeout > 0 && (killed || errors.Is(err, context.DeadlineExceeded)) {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+
+	return err
+}
+
+// tmuxRunner runs tmux with args within timeout, 0 for no limit, and returns its output;
+// only stdout for a query, and combined with stderr for commands, which may warn
+type tmuxRunner func(timeout time.Duration, query bool, args []string) (string, error)
+
+// runner runs tmux for runTmux, sourceTmux and queryTmux. Tests replace it to run
+// without a tmux server.
+var runner tmuxRunner = execTmux
+
+// execTmux runs the tmux binary as a tmuxRunner
+func execTmux(timeout time.Duration, query bool, args []string) (string, error) {
+	cmd, cancel := tmuxCommand(timeout, args)
+	defer cancel()
+
+	var out []byte
+	var err error
+	if query {
+		out, err = cmd.Output()
+	} else {
+		out, err = cmd.CombinedOutput()
+	}
+
+	return string(out), timedOut(cmd, timeout, err)
+}
+
+// runTmux invokes tmux with the given commands, and returns its combined output, which
+// may hold warnings even if the commands succeed
+func runTmux(cmds ...[]string) (string, error) {
+	var s []string
+	for _, c := range cmds {
+		s = append(s, c...)
+		if s[len(s)-1] != ";" {
+			s = append(s, ";")
+		}
+	}
+
+	out, err := runner(batchTimeout, false, s)
+	if err != nil {
+		return out, fmt.Errorf("failed to run tmux command %v (%s) %w", s, out, err)
+	}
+
+	return out, nil
+}
+
+// sourceTmux runs the commands like runTmux, from a temporary file that tmux sources
+// instead of the command line, so that there is no limit on their length. They are
+// written on a single line, to stop at the first failing command like a batch does.
+func sourceTmux(cmds ...[]string) (string, error) {
+	f, err := os.CreateTemp("", "tmux-workspace-*.conf")
+	if err != nil {
+		return "", fmt.Errorf("failed to create the file to source: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	var s []string
+	for _, c := range cmds {
+		s = append(s, c...)
+		if s[len(s)-1] != ";" {
+			s = append(s, ";")
+		}
+	}
+	if _, err := f.WriteString(formatCommands(s) + "\n"); err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to write to %s: %w", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to write to %s: %w", f.Name(), err)
+	}
+
+	out, err := runner(batchTimeout, false, []string{"source-file", f.Name()})
+	if err != nil {
+		return out, fmt.Errorf("failed to source tmux commands %v (%s) %w", s, out, err)
+	}
+
+	return out, nil
+}
+
+// splitCommands splits a flat list of tmux arguments into separate commands at each ";"
+func splitCommands(cmds []string) [][]string {
+	var result [][]string
+	var cmd []string
+	for _, arg := range cmds {
+		if arg == ";" {
+			if len(cmd) > 0 {
+				result = append(result, cmd)
+			}
+			cmd = nil
+			continue
+		}
+		cmd = append(cmd, arg)
+	}
+
+	if len(cmd) > 0 {
+		result = append(result, cmd)
+	}
+
+	return result
+}
+
+// unquotedArg matches the arguments that need no quoting in a tmux command string
+var unquotedArg = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// tmuxQuote formats a command as a tmux command string, single quoting the arguments that need it
+func tmuxQuote(cmd []string) string {
+	quoted := make([]string, len(cmd))
+	for i, arg := range cmd {
+		if unquotedArg.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// formatCommands formats a flat list of tmux arguments as a tmux command string
+func formatCommands(cmds []string) string {
+	var s []string
+	for _, cmd := range splitCommands(cmds) {
+		s = append(s, tmuxQuote(cmd)+" ;")
+	}
+
+	return strings.Join(s, " ")
+}
+
+// formatControlMode formats a flat list of tmux arguments for tmux control mode, one command per line
+func formatControlMode(cmds []string) string {
+	var s strings.Builder
+	for _, cmd := range splitCommands(cmds) {
+		s.WriteString(tmuxQuote(cmd) + "\n")
+	}
+
+	return s.String()
+}
+
+// writeControlMode appends the commands to the file at path, formatted for tmux control mode
+func writeControlMode(path string, cmds []string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	if _, err := f.WriteString(formatControlMode(cmds)); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write to %s: %w", path, err)
+	}
+
+	return f.Close()
+}
+
+// queryLog holds the queries made by queryTmux along with their results, when non-nil
+var queryLog *[]string
+
+// queryTmux invokes tmux to query some state, and returns the output
+func queryTmux(args ...string) (string, error) {
+	out, err := runner(queryTimeout, true, args)
+	if queryLog != nil {
+		result := fmt.Sprintf("%q", strings.Split(strings.TrimSpace(out), "\n"))
+		if err != nil {
+			result = err.Error()
+		}
+		*queryLog = append(*queryLog, fmt.Sprintf("%s -> %s", tmuxQuote(append([]string{"tmux"}, args...)), result))
+	}
+
+	return out, err
+}
+
+// clientSize returns the size of the current window, or of the terminal when not running inside tmux
+func clientSize() (width, height string, err error) {
+	if os.Getenv("TMUX") != "" {
+		out, err := queryTmux("display-message", "-p", "#{window_width} #{window_height}")
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get the window size: %w", err)
+		}
+		fmt.Sscan(out, &width, &height)
+		return width, height, nil
+	}
+
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get the terminal size: %w", err)
+	}
+	fmt.Sscan(string(out), &height, &width)
+
+	return width, height, nil
+}
+
+// paneAttr invokes tmux list-panes to fetch a pane attribute, and returns a slice with an entry for each pane
+// of the target window, or of the current window if target is empty
+func paneAttr(target, attr string) ([]string, error) {
+	args := []string{"list-panes", "-F", "#{" + attr + "}" + recordSeparator}
+	if target != "" {
+		args = append(args, "-t", target)
+	}
+
+	out, err := queryTmux(args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attribute %v: %w", attr, err)
+	}
+
+	return splitRecords(out), nil
+}
+
+// recordSeparator ends each value in the output of list-panes, list-windows and the
+// other list commands, as the values may contain newlines, or be empty
+const recordSeparator = "\x1e"
+
+// fieldSeparator separates the values of a record with several of them, as the values
+// may contain tabs and spaces
+const fieldSeparator = "\x1f"
+
+// splitRecords splits the output of a list command into its values
+func splitRecords(out string) []string {
+	records := strings.Split(out, recordSeparator+"\n")
+	if len(records) > 1 {
+		records = records[:len(records)-1]
+	}
+
+	return records
+}
+
+// windowAttr invokes tmux list-windows to fetch a window attribute, and returns a slice with an entry for
+// each window of the session
+func windowAttr(session, attr string) ([]string, error) {
+	out, err := queryTmux("list-windows", "-F", "#{"+attr+"}"+recordSeparator, "-t", session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attribute %v: %w", attr, err)
+	}
+
+	return splitRecords(out), nil
+}
+
+// windowOption invokes tmux show-options to fetch a window option of the target window.
+// An unset option gives the empty string.
+func windowOption(target, name string) (string, error) {
+	out, err := queryTmux("show-options", "-w", "-v", "-q", "-t", target, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to get option %v: %w", name, err)
+	}
+
+	return strings.TrimSpace(out), nil
+}
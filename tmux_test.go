@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTmux answers the queries of a test from replies, keyed by the arguments joined
+// with spaces, and records the batches of commands it's asked to run. A batch gets the
+// result of batch if it's set, and succeeds without output otherwise.
+type fakeTmux struct {
+	replies map[string]string
+	batch   func(args []string) (string, error)
+	batches [][]string
+}
+
+// run is the tmuxRunner of the fake
+func (f *fakeTmux) run(timeout time.Duration, query bool, args []string) (string, error) {
+	if !query {
+		f.batches = append(f.batches, args)
+		if f.batch != nil {
+			return f.batch(args)
+		}
+		return "", nil
+	}
+
+	out, ok := f.replies[strings.Join(args, " ")]
+	if !ok {
+		return "", fmt.Errorf("unexpected query: %s", strings.Join(args, " "))
+	}
+
+	return out, nil
+}
+
+// useFake replaces the tmux runner with f until the end of the test
+func useFake(t *testing.T, f *fakeTmux) {
+	old := runner
+	runner = f.run
+	t.Cleanup(func() { runner = old })
+}
+
+// paneQuery and windowQuery are the keys of the replies to paneAttr and windowAttr
+func paneQuery(target, attr string) string {
+	return "list-panes -F #{" + attr + "}" + recordSeparator + " -t " + target
+}
+
+func windowQuery(session, attr string) string {
+	return "list-windows -F #{" + attr + "}" + recordSeparator + " -t " + session
+}
+
+// optionQuery is the key of the reply to windowOption
+func optionQuery(target, name string) string {
+	return "show-options -w -v -q -t " + target + " " + name
+}
+
+// records formats values like the output of list-panes and list-windows
+func records(values ...string) string {
+	var b strings.Builder
+	for _, v := range values {
+		b.WriteString(v + recordSeparator + "\n")
+	}
+
+	return b.String()
+}
+
+func TestSplitRecords(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{"plain values", "0\x1e\n1\x1e\n2\x1e\n", []string{"0", "1", "2"}},
+		{"single value", "/tmp/proj\x1e\n", []string{"/tmp/proj"}},
+		{"embedded newline", "first\nsecond\x1e\nthird\x1e\n", []string{"first\nsecond", "third"}},
+		{"trailing newline in a value", "title\n\x1e\nx\x1e\n", []string{"title\n", "x"}},
+		{"empty values", "\x1e\n\x1e\nx\x1e\n", []string{"", "", "x"}},
+		{"only empty values", "\x1e\n\x1e\n", []string{"", ""}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := splitRecords(tc.out); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("splitRecords(%q) = %q, want %q", tc.out, got, tc.want)
+			}
+		})
+	}
+}
+
+// fields formats values like a record of several values of a list command
+func fields(values ...string) string {
+	return strings.Join(values, fieldSeparator)
+}
+
+func TestCaptureTemplateOddValues(t *testing.T) {
+	format := fields("#{window_layout}", "#{pane_current_path}", "#{pane_current_command}", "#{pane_start_command}")
+	useFake(t, &fakeTmux{replies: map[string]string{
+		"list-panes -t s:w -F " + format + recordSeparator: records(
+			fields("abcd,200x50,0,0", "/tmp/my\tproj", "bash", ""),
+			fields("abcd,200x50,0,0", "/tmp/my\tproj/sub dir", "sh", "printf 'a\tb\n'"),
+		),
+		"show-options -gv default-shell": "/bin/bash\n",
+	}})
+
+	got, err := captureTemplate("s", "w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &template{Layout: "abcd,200x50,0,0", Panes: []templatePane{
+		{Dir: "", Command: ""},
+		{Dir: "sub dir", Command: "printf 'a\tb\n'"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("captured %+v, want %+v", got, want)
+	}
+}
+
+func TestEmptiestSessionOddNames(t *testing.T) {
+	useFake(t, &fakeTmux{replies: map[string]string{
+		"list-sessions -F " + fields("#{session_windows}", "#{session_name}") + recordSeparator: records(
+			fields("3", "main"),
+			fields("1", "my work\tnotes"),
+			fields("1", "later"),
+		),
+	}})
+
+	got, err := emptiestSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "my work\tnotes" {
+		t.Errorf("emptiest session is %q, want %q", got, "my work\tnotes")
+	}
+}